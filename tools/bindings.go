@@ -1,10 +1,14 @@
 package tools
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"unsafe"
 
 	"gopkg.in/bblfsh/sdk.v1/uast"
@@ -16,11 +20,11 @@ import (
 // This is what happens during `make dependencies`. It is the default.
 //
 // Build tags:
-// custom_libuast - disables all the default CXXFLAGS and LDFLAGS.
+// custom_libuast - disables all the default CFLAGS, CXXFLAGS and LDFLAGS.
 // host_libuast - forces hosted mode.
 //
 // !unix defaults:
-// CFLAGS: -Iinclude -DLIBUAST_STATIC
+// CFLAGS: -Iinclude -Iinclude/libxml2 -DLIBUAST_STATIC
 // CXXFLAGS: -Iinclude -DLIBUAST_STATIC
 // LDFLAGS: -luast -lxml2 -Llib -static -lstdc++ -static-libgcc
 // Notes: static linkage, libuast installation prefix is expected
@@ -28,6 +32,7 @@ import (
 // CFLAGS and CXXFLAGS be set.
 //
 // unix defaults:
+// CFLAGS: -I/usr/local/include -I/usr/local/include/libxml2 -I/usr/include -I/usr/include/libxml2
 // CXXFLAGS: -I/usr/local/include -I/usr/local/include/libxml2 -I/usr/include -I/usr/include/libxml2
 // LDFLAGS: -lxml2
 // Notes: expects the embedded mode. "host_libuast" tag prepends -luast to LDFLAGS.
@@ -36,7 +41,8 @@ import (
 // Cannot actually use "unix" tag until this is resolved: https://github.com/golang/go/issues/20322
 // So inverted the condition: unix == !windows here.
 
-// #cgo !custom_libuast,windows CFLAGS: -Iinclude -DLIBUAST_STATIC
+// #cgo !custom_libuast,windows CFLAGS: -Iinclude -Iinclude/libxml2 -DLIBUAST_STATIC
+// #cgo !custom_libuast,!windows CFLAGS: -I/usr/local/include -I/usr/local/include/libxml2 -I/usr/include -I/usr/include/libxml2
 // #cgo !custom_libuast,windows CXXFLAGS: -Iinclude -DLIBUAST_STATIC
 // #cgo !custom_libuast,!windows CXXFLAGS: -I/usr/local/include -I/usr/local/include/libxml2 -I/usr/include -I/usr/include/libxml2
 // #cgo !custom_libuast,host_libuast !custom_libuast,windows LDFLAGS: -luast
@@ -46,12 +52,6 @@ import (
 // #include "bindings.h"
 import "C"
 
-var (
-	findMutex sync.Mutex
-	spool     cstringPool
-	kpool     = make(map[*uast.Node][]string)
-)
-
 type ErrInvalidArgument struct {
 	Message string
 }
@@ -78,7 +78,133 @@ func (e *errInternal) Error() string {
 	return fmt.Sprintf("%s() failed: %s", e.Method, e.Message)
 }
 
-var itMutex sync.Mutex
+// ErrorKind classifies the errors found running a query.
+type ErrorKind int
+
+const (
+	// RuntimeError is a failure of the query engine not caused by the query,
+	// like running out of memory.
+	RuntimeError ErrorKind = iota
+	// SyntaxError means the query is not valid: it is malformed or it refers
+	// to unknown functions, variables or namespace prefixes.
+	SyntaxError
+	// ResultTypeError means the query is valid but its result has a different
+	// type than the one expected, like a number given to Filter.
+	ResultTypeError
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case RuntimeError:
+		return "runtime error"
+	case SyntaxError:
+		return "syntax error"
+	case ResultTypeError:
+		return "result type error"
+	default:
+		return fmt.Sprintf("ErrorKind(%d)", int(k))
+	}
+}
+
+// FilterError is the error returned when a query or an iterator fails. Its
+// Kind tells apart the errors caused by the query from the failures of the
+// engine, which are the only ones of the iterators. The misuses of the API,
+// like calling Next on a finished iterator or having too many concurrent
+// queries and iterators, have errors of their own.
+type FilterError struct {
+	// Query is the XPath expression that failed, empty for the iterators.
+	Query string
+	// Kind is the class of the error.
+	Kind ErrorKind
+	// Msg is the error message given by libxml2 or libuast.
+	Msg string
+}
+
+func (e *FilterError) Error() string {
+	if e.Query == "" {
+		return fmt.Sprintf("%s: %s", e.Kind, e.Msg)
+	}
+	return fmt.Sprintf("%s in query %q: %s", e.Kind, e.Query, e.Msg)
+}
+
+// Unwrap returns an *ErrInvalidArgument with the message of the syntax errors,
+// which were returned as such before FilterError existed, so errors.As keeps
+// finding it for them.
+func (e *FilterError) Unwrap() error {
+	if e.Kind != SyntaxError {
+		return nil
+	}
+	return &ErrInvalidArgument{Message: e.Msg}
+}
+
+// isSyntaxError reports whether err is a *FilterError of kind SyntaxError.
+func isSyntaxError(err error) bool {
+	e, ok := err.(*FilterError)
+	return ok && e.Kind == SyntaxError
+}
+
+// xpathErrorKind returns the kind of the libxml2 XPath error with the given
+// xmlXPathError code, which is -1 for the failures not coming from libxml2.
+func xpathErrorKind(code C.int) ErrorKind {
+	switch code {
+	case C.XPATH_NUMBER_ERROR,
+		C.XPATH_UNFINISHED_LITERAL_ERROR,
+		C.XPATH_START_LITERAL_ERROR,
+		C.XPATH_VARIABLE_REF_ERROR,
+		C.XPATH_UNDEF_VARIABLE_ERROR,
+		C.XPATH_INVALID_PREDICATE_ERROR,
+		C.XPATH_EXPR_ERROR,
+		C.XPATH_UNCLOSED_ERROR,
+		C.XPATH_UNKNOWN_FUNC_ERROR,
+		C.XPATH_INVALID_OPERAND,
+		C.XPATH_INVALID_TYPE,
+		C.XPATH_INVALID_ARITY,
+		C.XPTR_SYNTAX_ERROR,
+		C.XPATH_UNDEF_PREFIX_ERROR,
+		C.XPATH_INVALID_CHAR_ERROR,
+		C.XPATH_FORBID_VARIABLE_ERROR:
+		return SyntaxError
+	default:
+		return RuntimeError
+	}
+}
+
+// uastMutex guards the libuast state and its error message, a single buffer
+// for all the calls. The libuast and libxml2 calls hold it for reading, so they
+// can run concurrently, and a failed call is run again holding it for writing
+// before reading the message, so no other call can overwrite it. CloseUast
+// holds it for writing to free the state.
+var uastMutex sync.RWMutex
+
+// uastClosed is true once CloseUast freed the libuast state, until it's
+// created again by the next call. liveIterators is the number of iterators not
+// disposed, which keep using the state. uastClosed is guarded by uastMutex.
+var (
+	uastClosed    bool
+	liveIterators int64
+)
+
+// rlockUast locks uastMutex for reading, creating the libuast state again if
+// it was closed.
+func rlockUast() {
+	uastMutex.RLock()
+	for uastClosed {
+		uastMutex.RUnlock()
+		lockUast()
+		uastMutex.Unlock()
+		uastMutex.RLock()
+	}
+}
+
+// lockUast locks uastMutex for writing, creating the libuast state again if
+// it was closed.
+func lockUast() {
+	uastMutex.Lock()
+	if uastClosed {
+		C.CreateUast()
+		uastClosed = false
+	}
+}
 
 // TreeOrder represents the traversal strategy for UAST trees
 type TreeOrder int
@@ -90,92 +216,542 @@ const (
 	PostOrder
 	// LevelOrder (aka breadth-first) traversal
 	LevelOrder
-	// PositionOrder by node position in the source file
+	// PositionOrder by node position in the source file. Nodes without a start
+	// position are sorted as if they were at the start of the file, so they come
+	// first.
 	PositionOrder
+	// ReverseLevelOrder is the LevelOrder traversal backwards: from the last
+	// node of the deepest level to the root, so every node comes after all its
+	// descendants.
+	ReverseLevelOrder
+	// ReversePositionOrder is the PositionOrder traversal backwards, from the
+	// node positioned last in the source file.
+	ReversePositionOrder
 )
 
+// base returns the libuast traversal the order is built on.
+func (o TreeOrder) base() TreeOrder {
+	switch o {
+	case ReverseLevelOrder:
+		return LevelOrder
+	case ReversePositionOrder:
+		return PositionOrder
+	default:
+		return o
+	}
+}
+
+func (o TreeOrder) reverse() bool {
+	return o != o.base()
+}
+
 // Iterator allows for traversal over a UAST tree.
 type Iterator struct {
-	root     *uast.Node
+	// mu serializes the calls on the iterator. The libuast state shared by all
+	// the iterators is only read, under uastMutex.
+	mu sync.Mutex
+
+	// roots are traversed one after the other, next is the index of the one
+	// to traverse once the current one finishes.
+	roots    []*uast.Node
+	next     int
+	order    TreeOrder
 	iterPtr  C.uintptr_t
+	table    *nodeTable
 	finished bool
+
+	// done is closed by Dispose to stop the goroutines sending the nodes of
+	// Iterate and IterateErr.
+	done     chan struct{}
+	disposed bool
+
+	// depth is the depth of the node last returned by Next, -1 if none.
+	depth int
+
+	// peeked tells if Peek has already read the result of the next call to
+	// Next, which is kept in peekNode, peekDepth and peekErr.
+	peeked    bool
+	peekNode  *uast.Node
+	peekDepth int
+	peekErr   error
+
+	// reversed holds, for the reverse orders, the handles of the nodes not
+	// returned yet of the base traversal, which are returned from the end.
+	reversed []C.uintptr_t
+	loaded   bool
 }
 
 func init() {
 	C.CreateUast()
 }
 
-func nodeToPtr(node *uast.Node) C.uintptr_t {
-	return C.uintptr_t(uintptr(unsafe.Pointer(node)))
-}
+// CloseUast frees the libuast state created when the package is initialized,
+// e.g. to release all the native memory at the end of the tests when looking
+// for leaks. All iterators must have been disposed, otherwise an error is
+// returned and nothing is freed. The state is created again by the next query
+// or iterator, so it's safe to call at any time, but it also cleans up the
+// global libxml2 state, which is costly.
+func CloseUast() error {
+	uastMutex.Lock()
+	defer uastMutex.Unlock()
+
+	if n := atomic.LoadInt64(&liveIterators); n > 0 {
+		return &errInternal{Method: "CloseUast", Message: fmt.Sprintf("%d iterators not disposed", n)}
+	}
 
-func ptrToNode(ptr C.uintptr_t) *uast.Node {
-	return (*uast.Node)(unsafe.Pointer(uintptr(ptr)))
+	if !uastClosed {
+		C.FreeUast()
+		uastClosed = true
+	}
+	return nil
 }
 
-// initFilter converts the query string and node pointer to C types. It acquires findMutex
-// and initializes the string pool. The caller should defer returned function to release
-// the resources.
-func initFilter(node *uast.Node, xpath string) (*C.char, C.uintptr_t, func()) {
-	findMutex.Lock()
-	cquery := spool.getCstring(xpath)
-	ptr := nodeToPtr(node)
+// callLibuast runs the libuast call made by `call`, which returns false if it
+// failed, and returns the error message of the failure and the code of its
+// XPath error, if it is a query. The failed calls are run twice, see
+// uastMutex.
+func callLibuast(call func() bool) (string, C.int, bool) {
+	rlockUast()
+	ok := call()
+	uastMutex.RUnlock()
+	if ok {
+		return "", 0, true
+	}
+
+	lockUast()
+	defer uastMutex.Unlock()
 
-	return cquery, ptr, func() {
-		spool.release()
-		kpool = make(map[*uast.Node][]string)
-		findMutex.Unlock()
+	if call() {
+		return "", 0, true
 	}
-}
 
-func cError(name string) error {
 	e := C.Error()
-	msg := strings.TrimSpace(C.GoString(e))
+	msg := C.GoString(e)
 	C.free(unsafe.Pointer(e))
-	// TODO: find a way to access this error code or constant
-	if strings.HasPrefix(msg, "Invalid expression") {
-		return &ErrInvalidArgument{Message: msg}
+	return msg, C.XPathError(), false
+}
+
+// filterCall runs the libuast call of a query, returning the *FilterError of
+// its failure.
+func filterCall(query string, call func() bool) error {
+	if msg, code, ok := callLibuast(call); !ok {
+		return newFilterError(query, msg, code)
 	}
-	return &errInternal{Method: name, Message: msg}
+	return nil
+}
+
+// newFilterError returns the *FilterError for the given query, libxml2 or
+// libuast error message and xmlXPathError code.
+func newFilterError(query, msg string, code C.int) *FilterError {
+	msg = strings.TrimSpace(msg)
+	kind := xpathErrorKind(code)
+	// the result type is checked by libuast and the prepared queries, so it
+	// has no libxml2 code
+	if code < 0 && strings.HasPrefix(msg, "Result of expression is not") {
+		kind = ResultTypeError
+	}
+	return &FilterError{Query: query, Kind: kind, Msg: msg}
 }
 
 // Filter takes a `*uast.Node` and a xpath query and filters the tree,
 // returning the list of nodes that satisfy the given query.
-// Filter is thread-safe but not concurrent by an internal global lock.
+// Filter is thread-safe but not concurrent by an internal global lock, use a
+// Context for each goroutine to run queries concurrently.
 func Filter(node *uast.Node, xpath string) ([]*uast.Node, error) {
+	return defaultContext.Filter(node, xpath)
+}
+
+// FilterCtx is like Filter but it gives up returning ctx.Err() once `ctx` is
+// done. The query itself is run by a single cgo call which cannot be
+// interrupted, so the context is only checked before waiting for the internal
+// lock, once it is acquired, after running the query and then every 1024
+// results while converting them.
+func FilterCtx(ctx context.Context, node *uast.Node, xpath string) ([]*uast.Node, error) {
+	return defaultContext.FilterCtx(ctx, node, xpath)
+}
+
+// FilterWithLimit is like Filter but it returns at most `limit` nodes, the
+// first ones in the XPath document order, which is the order of a pre-order
+// traversal. Only the returned nodes are converted from the libuast results. A
+// `limit` <= 0 means no limit.
+// FilterWithLimit is thread-safe but not concurrent by an internal global lock.
+func FilterWithLimit(node *uast.Node, xpath string, limit int) ([]*uast.Node, error) {
+	return defaultContext.FilterWithLimit(node, xpath, limit)
+}
+
+// FilterChan is like Filter but it sends the results on the returned channel
+// as they are read from libuast, in document order, instead of building the
+// whole slice first. The channel is closed once all the results are sent or
+// the query fails, in which case the error is sent on the error channel. The
+// error channel is closed after the nodes one, without any error if the query
+// succeeded.
+//
+// The query runs in its own Context, so it does not block other queries while
+// the results are being sent, and the native results are kept until all of
+// them have been received: the nodes channel is unbuffered, so the query
+// advances only as fast as it is consumed. The caller must drain the channel,
+// otherwise the goroutine sending the results, the native results and one of
+// the slots for concurrent queries and iterators are never released.
+func FilterChan(node *uast.Node, xpath string) (<-chan *uast.Node, <-chan error) {
+	c := make(chan *uast.Node)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(c)
+		if err := NewContext().filterChan(node, xpath, c); err != nil {
+			errc <- err
+		}
+	}()
+
+	return c, errc
+}
+
+// FilterInto is like Filter but it appends the results to buf[:0], reusing its
+// capacity, and returns the resulting slice, so the callers running many
+// queries can reuse the same buffer instead of allocating a new slice for
+// every call. The previous contents of buf are overwritten, and a new array is
+// allocated only if its capacity is not enough for all the results. A nil buf
+// gives a new slice, as Filter does.
+// FilterInto is thread-safe but not concurrent by an internal global lock.
+func FilterInto(node *uast.Node, xpath string, buf []*uast.Node) ([]*uast.Node, error) {
+	return defaultContext.FilterInto(node, xpath, buf)
+}
+
+// FilterAll runs every query of `queries` over the same tree, returning their
+// results in the same order, like calling Filter for each of them but locking
+// and converting the tree once for all of them. A failing query does not stop
+// the others: its result is nil and its error is returned, together with the
+// other results, in a QueriesError.
+// FilterAll is thread-safe but not concurrent by an internal global lock.
+func FilterAll(node *uast.Node, queries []string) ([][]*uast.Node, error) {
+	return defaultContext.FilterAll(node, queries)
+}
+
+// FilterFirst returns the first node, in document order, that satisfies the
+// given query, or nil if there is none. Only that node is converted from the
+// libuast results.
+// FilterFirst is thread-safe but not concurrent by an internal global lock.
+func FilterFirst(node *uast.Node, xpath string) (*uast.Node, error) {
+	return defaultContext.FilterFirst(node, xpath)
+}
+
+// FilterCount returns the number of nodes that satisfy the given query, like
+// `len(Filter(node, xpath))` but without building the list of results.
+// FilterCount is thread-safe but not concurrent by an internal global lock.
+func FilterCount(node *uast.Node, xpath string) (int, error) {
+	return defaultContext.FilterCount(node, xpath)
+}
+
+// FilterBool takes a `*uast.Node` and a xpath query with a boolean
+// return type (e.g. when using XPath functions returning a boolean type).
+// FilterBool is thread-safe but not concurrent by an internal global lock.
+func FilterBool(node *uast.Node, xpath string) (bool, error) {
+	return defaultContext.FilterBool(node, xpath)
+}
+
+// EvalBool evaluates the xpath expression over the tree and returns its
+// result as a boolean. Unlike FilterBool, the expression can have any result
+// type, which is converted following the XPath `boolean()` function rules: a
+// node-set is true if it is not empty, a number if it is neither zero nor NaN
+// and a string if it is not empty.
+// EvalBool is thread-safe but not concurrent by an internal global lock.
+func EvalBool(node *uast.Node, xpath string) (bool, error) {
 	if len(xpath) == 0 || node == nil {
-		return nil, nil
+		return false, nil
+	}
+	return FilterBool(node, "boolean("+xpath+")")
+}
+
+// FilterBool takes a `*uast.Node` and a xpath query with a float
+// return type (e.g. when using XPath functions returning a float type).
+// FilterNumber is thread-safe but not concurrent by an internal global lock.
+func FilterNumber(node *uast.Node, xpath string) (float64, error) {
+	return defaultContext.FilterNumber(node, xpath)
+}
+
+// EvalNumber evaluates the xpath expression over the tree and returns its
+// numeric result, like `count(//*[@roleFunction])`. It returns an error if the
+// expression does not have a number result type or its result is NaN (e.g.
+// `number('foo')`).
+// EvalNumber is thread-safe but not concurrent by an internal global lock.
+func EvalNumber(node *uast.Node, xpath string) (float64, error) {
+	res, err := FilterNumber(node, xpath)
+	if err != nil {
+		return 0, err
+	}
+
+	if math.IsNaN(res) {
+		return 0, &errInternal{Method: "EvalNumber", Message: "expression result is NaN"}
+	}
+	return res, nil
+}
+
+// FilterString takes a `*uast.Node` and a xpath query with a string
+// return type (e.g. when using XPath functions returning a string type).
+// FilterString is thread-safe but not concurrent by an internal global lock.
+func FilterString(node *uast.Node, xpath string) (string, error) {
+	return defaultContext.FilterString(node, xpath)
+}
+
+// EvalString evaluates the xpath expression over the tree and returns its
+// result as a string. Unlike FilterString, the expression can have any result
+// type, which is converted following the XPath `string()` function rules: a
+// node-set is converted to the string value of its first node, so
+// `//*[@roleIdentifier][1]/@token` returns the token of the first identifier.
+// EvalString is thread-safe but not concurrent by an internal global lock.
+func EvalString(node *uast.Node, xpath string) (string, error) {
+	if len(xpath) == 0 || node == nil {
+		return "", nil
+	}
+	return FilterString(node, "string("+xpath+")")
+}
+
+// Filter is the Context version of the package level Filter function.
+func (c *Context) Filter(node *uast.Node, xpath string) ([]*uast.Node, error) {
+	return c.FilterCtx(context.Background(), node, xpath)
+}
+
+// cancelCheckInterval is the number of results converted between checks of
+// the cancellation of a FilterCtx call.
+const cancelCheckInterval = 1024
+
+// FilterCtx is the Context version of the package level FilterCtx function.
+func (c *Context) FilterCtx(ctx context.Context, node *uast.Node, xpath string) ([]*uast.Node, error) {
+	return c.filter(ctx, node, xpath, 0, nil)
+}
+
+// FilterWithLimit is the Context version of the package level FilterWithLimit
+// function.
+func (c *Context) FilterWithLimit(node *uast.Node, xpath string, limit int) ([]*uast.Node, error) {
+	return c.filter(context.Background(), node, xpath, limit, nil)
+}
+
+// FilterInto is the Context version of the package level FilterInto function.
+func (c *Context) FilterInto(node *uast.Node, xpath string, buf []*uast.Node) ([]*uast.Node, error) {
+	return c.filter(context.Background(), node, xpath, 0, buf[:0])
+}
+
+// filter returns up to `limit` results of the query, all of them if `limit`
+// is not positive, appended to `buf` or to a new slice if it is nil.
+func (c *Context) filter(ctx context.Context, node *uast.Node, xpath string, limit int, buf []*uast.Node) ([]*uast.Node, error) {
+	if len(xpath) == 0 || node == nil {
+		return buf, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	cquery, ptr, closer := initFilter(node, xpath)
+	cquery, ptr, closer, err := c.init(node, xpath)
+	if err != nil {
+		return nil, err
+	}
 	defer closer()
 
-	if !C.Filter(ptr, cquery) {
-		return nil, cError("UastFilter")
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var nodes *C.Nodes
+	if err := filterCall(xpath, func() bool {
+		nodes = C.Filter(ptr, cquery)
+		return nodes != nil
+	}); err != nil {
+		return nil, err
+	}
+	defer C.NodesFree(nodes)
+
+	nu := int(C.Size(nodes))
+	if limit > 0 && nu > limit {
+		nu = limit
 	}
 
-	nu := int(C.Size())
-	results := make([]*uast.Node, nu)
+	results := buf
+	if results == nil {
+		results = make([]*uast.Node, 0, nu)
+	}
 	for i := 0; i < nu; i++ {
-		results[i] = ptrToNode(C.At(C.int(i)))
+		if i%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, ptrToNode(C.At(nodes, C.int(i))))
 	}
 	return results, nil
 }
 
-// FilterBool takes a `*uast.Node` and a xpath query with a boolean
-// return type (e.g. when using XPath functions returning a boolean type).
-// FilterBool is thread-safe but not concurrent by an internal global lock.
-func FilterBool(node *uast.Node, xpath string) (bool, error) {
+// filterChan sends each result of the query on c as it is converted.
+func (c *Context) filterChan(node *uast.Node, xpath string, results chan<- *uast.Node) error {
+	if len(xpath) == 0 || node == nil {
+		return nil
+	}
+
+	cquery, ptr, closer, err := c.init(node, xpath)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	var nodes *C.Nodes
+	if err := filterCall(xpath, func() bool {
+		nodes = C.Filter(ptr, cquery)
+		return nodes != nil
+	}); err != nil {
+		return err
+	}
+	defer C.NodesFree(nodes)
+
+	nu := int(C.Size(nodes))
+	for i := 0; i < nu; i++ {
+		results <- ptrToNode(C.At(nodes, C.int(i)))
+	}
+	return nil
+}
+
+// QueriesError is returned by FilterAll when some of the queries failed. It
+// maps the index of every failing query to its error.
+type QueriesError map[int]error
+
+func (e QueriesError) Error() string {
+	if len(e) == 0 {
+		return "queries error"
+	}
+
+	indexes := make([]int, 0, len(e))
+	for i := range e {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	msgs := make([]string, len(indexes))
+	for j, i := range indexes {
+		msgs[j] = fmt.Sprintf("query %d: %s", i, e[i])
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// FilterAll is the Context version of the package level FilterAll function.
+func (c *Context) FilterAll(node *uast.Node, queries []string) ([][]*uast.Node, error) {
+	results := make([][]*uast.Node, len(queries))
+	if node == nil || len(queries) == 0 {
+		return results, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.table.acquire(); err != nil {
+		return nil, err
+	}
+	defer c.table.release()
+
+	ptr := c.table.handle(node)
+	errs := QueriesError{}
+	for q, xpath := range queries {
+		if len(xpath) == 0 {
+			continue
+		}
+
+		cquery := c.table.pool.getCstring(xpath)
+		var nodes *C.Nodes
+		err := filterCall(xpath, func() bool {
+			nodes = C.Filter(ptr, cquery)
+			return nodes != nil
+		})
+		// the strings of a query are not needed by the next ones
+		c.table.pool.release()
+		if err != nil {
+			errs[q] = err
+			continue
+		}
+
+		nu := int(C.Size(nodes))
+		results[q] = make([]*uast.Node, nu)
+		for i := 0; i < nu; i++ {
+			results[q][i] = ptrToNode(C.At(nodes, C.int(i)))
+		}
+		C.NodesFree(nodes)
+	}
+
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+// FilterFirst is the Context version of the package level FilterFirst
+// function.
+func (c *Context) FilterFirst(node *uast.Node, xpath string) (*uast.Node, error) {
+	if len(xpath) == 0 || node == nil {
+		return nil, nil
+	}
+
+	cquery, ptr, closer, err := c.init(node, xpath)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	var nodes *C.Nodes
+	if err := filterCall(xpath, func() bool {
+		nodes = C.Filter(ptr, cquery)
+		return nodes != nil
+	}); err != nil {
+		return nil, err
+	}
+	defer C.NodesFree(nodes)
+
+	if C.Size(nodes) == 0 {
+		return nil, nil
+	}
+	return ptrToNode(C.At(nodes, 0)), nil
+}
+
+// FilterCount is the Context version of the package level FilterCount
+// function.
+func (c *Context) FilterCount(node *uast.Node, xpath string) (int, error) {
+	if len(xpath) == 0 || node == nil {
+		return 0, nil
+	}
+
+	cquery, ptr, closer, err := c.init(node, xpath)
+	if err != nil {
+		return 0, err
+	}
+	defer closer()
+
+	var nodes *C.Nodes
+	if err := filterCall(xpath, func() bool {
+		nodes = C.Filter(ptr, cquery)
+		return nodes != nil
+	}); err != nil {
+		return 0, err
+	}
+	defer C.NodesFree(nodes)
+
+	return int(C.Size(nodes)), nil
+}
+
+// FilterBool is the Context version of the package level FilterBool function.
+func (c *Context) FilterBool(node *uast.Node, xpath string) (bool, error) {
 	if len(xpath) == 0 || node == nil {
 		return false, nil
 	}
 
-	cquery, ptr, closer := initFilter(node, xpath)
+	cquery, ptr, closer, err := c.init(node, xpath)
+	if err != nil {
+		return false, err
+	}
 	defer closer()
 
-	res := C.FilterBool(ptr, cquery)
-	if res < 0 {
-		return false, cError("UastFilterBool")
+	var res C.int
+	if err := filterCall(xpath, func() bool {
+		res = C.FilterBool(ptr, cquery)
+		return res >= 0
+	}); err != nil {
+		return false, err
 	}
 
 	var gores bool
@@ -190,65 +766,245 @@ func FilterBool(node *uast.Node, xpath string) (bool, error) {
 	return gores, nil
 }
 
-// FilterBool takes a `*uast.Node` and a xpath query with a float
-// return type (e.g. when using XPath functions returning a float type).
-// FilterNumber is thread-safe but not concurrent by an internal global lock.
-func FilterNumber(node *uast.Node, xpath string) (float64, error) {
+// FilterNumber is the Context version of the package level FilterNumber
+// function.
+func (c *Context) FilterNumber(node *uast.Node, xpath string) (float64, error) {
 	if len(xpath) == 0 || node == nil {
 		return 0, nil
 	}
 
-	cquery, ptr, closer := initFilter(node, xpath)
+	cquery, ptr, closer, err := c.init(node, xpath)
+	if err != nil {
+		return 0, err
+	}
 	defer closer()
 
-	var ok C.int
-	res := C.FilterNumber(ptr, cquery, &ok)
-	if ok == 0 {
-		return 0.0, cError("UastFilterNumber")
+	var res C.double
+	if err := filterCall(xpath, func() bool {
+		var ok C.int
+		res = C.FilterNumber(ptr, cquery, &ok)
+		return ok != 0
+	}); err != nil {
+		return 0.0, err
 	}
 
 	return float64(res), nil
 }
 
-// FilterString takes a `*uast.Node` and a xpath query with a string
-// return type (e.g. when using XPath functions returning a string type).
-// FilterString is thread-safe but not concurrent by an internal global lock.
-func FilterString(node *uast.Node, xpath string) (string, error) {
+// FilterString is the Context version of the package level FilterString
+// function.
+func (c *Context) FilterString(node *uast.Node, xpath string) (string, error) {
 	if len(xpath) == 0 || node == nil {
 		return "", nil
 	}
 
-	cquery, ptr, closer := initFilter(node, xpath)
+	cquery, ptr, closer, err := c.init(node, xpath)
+	if err != nil {
+		return "", err
+	}
 	defer closer()
 
 	var res *C.char
-	res = C.FilterString(ptr, cquery)
-	if res == nil {
-		return "", cError("UastFilterString")
+	if err := filterCall(xpath, func() bool {
+		res = C.FilterString(ptr, cquery)
+		return res != nil
+	}); err != nil {
+		return "", err
 	}
+	defer C.free(unsafe.Pointer(res))
 
 	return C.GoString(res), nil
 }
 
+// Warmup runs a trivial query and iteration over a small internal tree to pay
+// up front the one-time costs of the first call: the libxml2 XPath engine and
+// its error handler setup, the cgo callbacks used to export every node field
+// and the first allocations of the C string pool. It is meant to be called
+// during service startup so the first real query does not see that latency.
+func Warmup() error {
+	node := &uast.Node{
+		InternalType:  "warmup",
+		Token:         "warmup",
+		Roles:         []uast.Role{uast.Identifier},
+		Properties:    map[string]string{"key": "value"},
+		StartPosition: &uast.Position{Offset: 0, Line: 1, Col: 1},
+		EndPosition:   &uast.Position{Offset: 6, Line: 1, Col: 7},
+	}
+
+	if _, err := Filter(node, "//warmup[@token='warmup']"); err != nil {
+		return err
+	}
+
+	iter, err := NewIterator(node, PreOrder)
+	if err != nil {
+		return err
+	}
+	defer iter.Dispose()
+
+	_, err = iter.Next()
+	return err
+}
+
+// DescendantCount returns the number of nodes in the subtree rooted at `node`,
+// strictly excluding the node itself: a leaf has no descendants. The count is
+// computed by the libuast pre-order iterator without materializing any node.
+func DescendantCount(node *uast.Node) int {
+	if node == nil {
+		return 0
+	}
+
+	var t nodeTable
+	if t.acquire() != nil {
+		return 0
+	}
+	defer t.release()
+
+	rlockUast()
+	count := int(C.CountNodes(t.handle(node)))
+	uastMutex.RUnlock()
+	if count <= 0 {
+		return 0
+	}
+	return count - 1
+}
+
+// TokenDensity returns the ratio of descendants of `node` with a non-empty
+// token to the total number of descendants, the node itself excluded. Both
+// counts are computed in a single pass of the libuast pre-order iterator. A
+// leaf node, having no descendants, has a density of 0, as well as a nil node.
+func TokenDensity(node *uast.Node) float64 {
+	if node == nil {
+		return 0
+	}
+
+	var t nodeTable
+	if t.acquire() != nil {
+		return 0
+	}
+	defer t.release()
+
+	var total C.int
+	rlockUast()
+	tokens := C.CountTokens(t.handle(node), &total)
+	uastMutex.RUnlock()
+	if tokens < 0 || total == 0 {
+		return 0
+	}
+	return float64(tokens) / float64(total)
+}
+
+// SameTokenNodes returns, in pre-order, every node under `root` (including
+// itself) with the same token as `node`, as a syntactic approximation of the
+// uses of an identifier. If any `roles` are given, only the nodes having all of
+// them are returned. Nodes with an empty token never match. The tokens are
+// compared while walking the tree with the libuast pre-order iterator.
+func SameTokenNodes(root, node *uast.Node, roles ...uast.Role) []*uast.Node {
+	if root == nil || node == nil || node.Token == "" {
+		return nil
+	}
+
+	size := DescendantCount(root) + 1
+	var t nodeTable
+	if t.acquire() != nil {
+		return nil
+	}
+	defer t.release()
+
+	ptrs := make([]C.uintptr_t, size)
+	rlockUast()
+	count := int(C.SameTokenNodes(t.handle(root), t.handle(node), &ptrs[0], C.int(size)))
+	uastMutex.RUnlock()
+
+	var results []*uast.Node
+	for i := 0; i < count; i++ {
+		n := ptrToNode(ptrs[i])
+		if len(MatchingRoles(n, roles)) == len(roles) {
+			results = append(results, n)
+		}
+	}
+	return results
+}
+
+// resultType returns the actual result type reported by libuast when a query
+// has a different result type than the expected one, or "" otherwise.
+func resultType(err error) string {
+	e, ok := err.(*FilterError)
+	if !ok || e.Kind != ResultTypeError {
+		return ""
+	}
+
+	const prefix = "(is: "
+	idx := strings.Index(e.Msg, prefix)
+	if idx < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(e.Msg[idx+len(prefix):], ")")
+}
+
+// Eval evaluates the xpath expression over the tree and returns its result with
+// the Go type matching the XPath result type:
+//
+//	node-set: []*uast.Node
+//	boolean:  bool
+//	number:   float64
+//	string:   string
+//
+// Any other result type, only possible with XPath extensions, is an error.
+// Expressions not returning a node-set are evaluated twice, first to find out
+// their result type.
+// Eval is thread-safe but not concurrent by an internal global lock.
+func Eval(node *uast.Node, xpath string) (interface{}, error) {
+	nodes, err := Filter(node, xpath)
+	if err == nil {
+		return nodes, nil
+	}
+
+	switch t := resultType(err); t {
+	case "BOOLEAN":
+		return FilterBool(node, xpath)
+	case "NUMBER":
+		return FilterNumber(node, xpath)
+	case "STRING":
+		return FilterString(node, xpath)
+	case "":
+		return nil, err
+	default:
+		return nil, &errInternal{Method: "Eval", Message: "unsupported result type " + t}
+	}
+}
+
 //export goGetInternalType
 func goGetInternalType(ptr C.uintptr_t) *C.char {
-	return spool.getCstring(ptrToNode(ptr).InternalType)
+	return tableOf(ptr).pool.getCstring(ptrToNode(ptr).InternalType)
 }
 
 //export goGetToken
 func goGetToken(ptr C.uintptr_t) *C.char {
-	return spool.getCstring(ptrToNode(ptr).Token)
+	return tableOf(ptr).pool.getCstring(ptrToNode(ptr).Token)
+}
+
+//export goHasToken
+func goHasToken(ptr C.uintptr_t) C.bool {
+	return ptrToNode(ptr).Token != ""
+}
+
+//export goHasSameToken
+func goHasSameToken(ptr C.uintptr_t, other C.uintptr_t) C.bool {
+	return ptrToNode(ptr).Token == ptrToNode(other).Token
 }
 
 //export goGetChildrenSize
 func goGetChildrenSize(ptr C.uintptr_t) C.int {
-	return C.int(len(ptrToNode(ptr).Children))
+	if t := tableOf(ptr); t.limitDepth && ptrToDepth(ptr) >= t.maxDepth {
+		return 0
+	}
+	return C.int(len(ptrToChildren(ptr)))
 }
 
 //export goGetChild
 func goGetChild(ptr C.uintptr_t, index C.int) C.uintptr_t {
-	child := ptrToNode(ptr).Children[int(index)]
-	return nodeToPtr(child)
+	child := ptrToChildren(ptr)[int(index)]
+	return tableOf(ptr).childHandle(ptr, child)
 }
 
 //export goGetRolesSize
@@ -269,7 +1025,8 @@ func goGetPropertiesSize(ptr C.uintptr_t) C.int {
 
 func getPropertyKeys(ptr C.uintptr_t) []string {
 	node := ptrToNode(ptr)
-	if keys, ok := kpool[node]; ok {
+	t := tableOf(ptr)
+	if keys, ok := t.keys[node]; ok {
 		return keys
 	}
 	p := node.Properties
@@ -278,21 +1035,24 @@ func getPropertyKeys(ptr C.uintptr_t) []string {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
-	kpool[node] = keys
+	if t.keys == nil {
+		t.keys = make(map[*uast.Node][]string)
+	}
+	t.keys[node] = keys
 	return keys
 }
 
 //export goGetPropertyKey
 func goGetPropertyKey(ptr C.uintptr_t, index C.int) *C.char {
 	keys := getPropertyKeys(ptr)
-	return spool.getCstring(keys[int(index)])
+	return tableOf(ptr).pool.getCstring(keys[int(index)])
 }
 
 //export goGetPropertyValue
 func goGetPropertyValue(ptr C.uintptr_t, index C.int) *C.char {
 	keys := getPropertyKeys(ptr)
 	p := ptrToNode(ptr).Properties
-	return spool.getCstring(p[keys[int(index)]])
+	return tableOf(ptr).pool.getCstring(p[keys[int(index)]])
 }
 
 //export goHasStartOffset
@@ -382,46 +1142,252 @@ func goGetEndCol(ptr C.uintptr_t) C.uint32_t {
 // NewIterator constructs a new Iterator starting from the given `Node` and
 // iterating with the traversal strategy given by the `order` parameter. Once
 // the iteration have finished or you don't need the iterator anymore you must
-// dispose it with the Dispose() method (or call it with `defer`).
+// dispose it with the Dispose() method (or call it with `defer`). Every live
+// iterator counts towards the limit of 4096 queries and iterators in use at
+// the same time, see Context, until it is disposed or garbage collected.
 func NewIterator(node *uast.Node, order TreeOrder) (*Iterator, error) {
-	itMutex.Lock()
-	defer itMutex.Unlock()
+	return newIterator([]*uast.Node{node}, order, -1)
+}
+
+// NewIteratorDepth is like NewIterator but it doesn't descend past the nodes
+// at `maxDepth`, with the root at depth 0: the traversal is the one of the tree
+// truncated at that depth, as if those nodes had no children, and the children
+// of the nodes at `maxDepth` are never read. So, for PostOrder, the nodes at
+// `maxDepth` come right before their parent, as leaves do. A negative
+// `maxDepth` means no limit, as with NewIterator.
+func NewIteratorDepth(node *uast.Node, order TreeOrder, maxDepth int) (*Iterator, error) {
+	return newIterator([]*uast.Node{node}, order, maxDepth)
+}
+
+// NewIteratorForest constructs an Iterator traversing every tree rooted at the
+// given nodes in sequence, each one with the traversal strategy given by the
+// `order` parameter: all the nodes of nodes[0] come first, then the ones of
+// nodes[1], and so on. The nil nodes are skipped. As with NewIterator, the
+// iterator must be disposed with Dispose().
+func NewIteratorForest(nodes []*uast.Node, order TreeOrder) (*Iterator, error) {
+	roots := make([]*uast.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node != nil {
+			roots = append(roots, node)
+		}
+	}
+	return newIterator(roots, order, -1)
+}
 
-	ptr := nodeToPtr(node)
-	it := C.IteratorNew(ptr, C.int(order))
-	if it == 0 {
-		return nil, cError("UastIteratorNew")
+func newIterator(roots []*uast.Node, order TreeOrder, maxDepth int) (*Iterator, error) {
+	table := &nodeTable{limitDepth: maxDepth >= 0, maxDepth: maxDepth}
+	if err := table.acquire(); err != nil {
+		return nil, err
 	}
 
-	return &Iterator{
-		root:     node,
-		iterPtr:  it,
+	i := &Iterator{
+		roots:    roots,
+		order:    order,
+		table:    table,
 		finished: false,
-	}, nil
+		done:     make(chan struct{}),
+		depth:    -1,
+	}
+
+	// counted before creating the C iterator so CloseUast can't free the state
+	// it uses
+	atomic.AddInt64(&liveIterators, 1)
+	if _, err := i.nextRoot(); err != nil {
+		atomic.AddInt64(&liveIterators, -1)
+		table.release()
+		return nil, err
+	}
+
+	// The iterator can't be collected while Next runs, since Next holds a
+	// reference to it, nor while a goroutine of Iterate is sending its nodes.
+	runtime.SetFinalizer(i, (*Iterator).Dispose)
+	return i, nil
+}
+
+// nextRoot frees the traversal of the current root and starts the one of the
+// next root, returning false if there are no more.
+func (i *Iterator) nextRoot() (bool, error) {
+	if i.iterPtr != 0 {
+		C.IteratorFree(i.iterPtr)
+		i.iterPtr = 0
+	}
+	i.table.clear()
+	i.reversed = nil
+	i.loaded = false
+
+	if i.next >= len(i.roots) {
+		return false, nil
+	}
+
+	root := i.table.handle(i.roots[i.next])
+	var it C.uintptr_t
+	if msg, _, ok := callLibuast(func() bool {
+		it = C.IteratorNew(root, C.int(i.order.base()))
+		return it != 0
+	}); !ok {
+		return false, &FilterError{Kind: RuntimeError, Msg: strings.TrimSpace(msg)}
+	}
+
+	i.iterPtr = it
+	i.next++
+	return true, nil
 }
 
 // Next retrieves the next `Node` in the tree's traversal or `nil` if there are no more
 // nodes. Calling `Next()` on a finished iterator after the first `nil` will
-// return an error.This is thread-safe but not concurrent by an internal global lock.
+// return an error. This is thread-safe: the calls on the same iterator are
+// serialized by a lock of the iterator, and different iterators can advance
+// concurrently.
 func (i *Iterator) Next() (*uast.Node, error) {
-	itMutex.Lock()
-	defer itMutex.Unlock()
+	n, _, err := i.nextWithDepth(context.Background())
+	return n, err
+}
 
-	if i.finished {
-		return nil, fmt.Errorf("Next() called on finished iterator")
+// NextCtx is like Next but it gives up returning ctx.Err() once `ctx` is done,
+// which is checked before waiting for the internal lock and before every call
+// to libuast to get the next node. A single call to libuast cannot be
+// interrupted, so the node read by a call that started before `ctx` was done
+// is still returned; note that for the reverse orders the first call reads the
+// whole traversal. Once NextCtx returned the error of `ctx`, the iteration can
+// go on calling Next or NextCtx with another context.
+func (i *Iterator) NextCtx(ctx context.Context) (*uast.Node, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	pnode := C.IteratorNext(i.iterPtr)
-	if pnode == 0 {
+	n, _, err := i.nextWithDepth(ctx)
+	return n, err
+}
+
+// nextWithDepth is NextCtx also returning the depth of the node, read under
+// the same lock.
+func (i *Iterator) nextWithDepth(ctx context.Context) (*uast.Node, int, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var (
+		n     *uast.Node
+		depth int
+		err   error
+	)
+	if i.peeked {
+		n, depth, err = i.peekNode, i.peekDepth, i.peekErr
+		i.clearPeek()
+	} else {
+		if i.finished {
+			return nil, -1, fmt.Errorf("Next() called on finished iterator")
+		}
+		n, depth, err = i.advance(ctx)
+	}
+
+	if err != nil {
+		i.depth = -1
+		return nil, -1, err
+	}
+
+	i.depth = depth
+	if n == nil {
 		// End of the iteration
 		i.finished = true
-		return nil, nil
 	}
-	return ptrToNode(pnode), nil
+	return n, depth, nil
+}
+
+// advance reads the next node of the traversal and its depth, or nil at the
+// end, without updating the state of the iterator seen by Next. It returns
+// ctx.Err() before calling libuast if `ctx` is done.
+func (i *Iterator) advance(ctx context.Context) (*uast.Node, int, error) {
+	var pnode C.uintptr_t
+	for i.iterPtr != 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, -1, err
+		}
+
+		rlockUast()
+		if i.order.reverse() {
+			pnode = i.nextReversed()
+		} else {
+			pnode = C.IteratorNext(i.iterPtr)
+		}
+		uastMutex.RUnlock()
+
+		if pnode != 0 {
+			break
+		}
+
+		if _, err := i.nextRoot(); err != nil {
+			return nil, -1, err
+		}
+	}
+
+	if pnode == 0 {
+		return nil, -1, nil
+	}
+	return ptrToNode(pnode), ptrToDepth(pnode), nil
+}
+
+// Peek returns what the next call to Next will return without consuming it,
+// so Peek can be called any number of times before that Next call: the next
+// node, nil if the iteration is about to finish, or the error of reading the
+// next node. Like Next, it returns an error if called on a finished or
+// disposed iterator. Peek does not change the node seen by Depth.
+// Like Next, this is thread-safe.
+func (i *Iterator) Peek() (*uast.Node, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if !i.peeked {
+		if i.finished {
+			return nil, fmt.Errorf("Peek() called on finished iterator")
+		}
+		i.peekNode, i.peekDepth, i.peekErr = i.advance(context.Background())
+		i.peeked = true
+	}
+	return i.peekNode, i.peekErr
+}
+
+func (i *Iterator) clearPeek() {
+	i.peeked = false
+	i.peekNode = nil
+	i.peekErr = nil
+}
+
+// Depth returns the depth of the node last returned by Next. The depth is
+// relative to the root of the iteration, which has depth 0, or to the root of
+// each tree for the iterators of a forest. It is -1 before the first call to
+// Next and after the end of the iteration.
+func (i *Iterator) Depth() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.depth
+}
+
+// nextReversed returns the handle of the next node of a reverse order
+// traversal, or 0 at the end, loading the whole base traversal on the first
+// call.
+func (i *Iterator) nextReversed() C.uintptr_t {
+	if !i.loaded {
+		for pnode := C.IteratorNext(i.iterPtr); pnode != 0; pnode = C.IteratorNext(i.iterPtr) {
+			i.reversed = append(i.reversed, pnode)
+		}
+		i.loaded = true
+	}
+
+	if len(i.reversed) == 0 {
+		return 0
+	}
+
+	last := len(i.reversed) - 1
+	pnode := i.reversed[last]
+	i.reversed = i.reversed[:last]
+	return pnode
 }
 
 // Iterate function is similar to Next() but returns the `Node`s in a channel. It's mean
 // to be used with the `for node := range myIter.Iterate() {}` loop.
+// Iterate is lossy: an error returned by Next just closes the channel as the
+// end of the iteration does, use IterateErr to tell them apart.
 func (i *Iterator) Iterate() <-chan *uast.Node {
 	c := make(chan *uast.Node)
 	if i.finished {
@@ -437,24 +1403,213 @@ func (i *Iterator) Iterate() <-chan *uast.Node {
 				break
 			}
 
-			c <- n
+			select {
+			case c <- n:
+			case <-i.done:
+				close(c)
+				return
+			}
 		}
 	}()
 
 	return c
 }
 
+// NodeDepth is a node of a traversal with its depth relative to the root of
+// the iteration, which has depth 0.
+type NodeDepth struct {
+	Node  *uast.Node
+	Depth int
+}
+
+// IterateWithDepth is like Iterate but sends every node with its depth, so a
+// tree can be rendered or indexed in a single pass without keeping a stack.
+// Like Iterate, it is lossy: an error returned by Next just closes the channel,
+// and the channel is closed once the iterator is disposed.
+func (i *Iterator) IterateWithDepth() <-chan NodeDepth {
+	c := make(chan NodeDepth)
+	if i.finished {
+		close(c)
+		return c
+	}
+
+	go func() {
+		defer close(c)
+		for {
+			n, depth, err := i.nextWithDepth(context.Background())
+			if n == nil || err != nil {
+				return
+			}
+
+			select {
+			case c <- NodeDepth{Node: n, Depth: depth}:
+			case <-i.done:
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+// Reset restarts the traversal from the root node (or the first root of the
+// forest) the iterator was created with, using the same order, even if it had
+// finished. It returns an error if the iterator has been disposed.
+func (i *Iterator) Reset() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.disposed {
+		return fmt.Errorf("Reset() called on disposed iterator")
+	}
+	return i.restart()
+}
+
+// Reinit restarts the iterator to traverse the tree rooted at node with the
+// given order, as a new iterator from NewIterator would, but reusing the
+// iterator and its resources instead of disposing it and creating a new one.
+// libuast can't restart its iterators, so its iterator is still freed and a
+// new one created. The depth limit given to NewIteratorDepth is kept. The
+// channels returned by Iterate and the like before Reinit must not be used
+// after it. It returns an error if the iterator has been disposed.
+func (i *Iterator) Reinit(node *uast.Node, order TreeOrder) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.disposed {
+		return fmt.Errorf("Reinit() called on disposed iterator")
+	}
+
+	for j := range i.roots {
+		i.roots[j] = nil
+	}
+	i.roots = append(i.roots[:0], node)
+	i.order = order
+	return i.restart()
+}
+
+// restart starts the traversal again from the first root, leaving the
+// iterator finished if it fails.
+func (i *Iterator) restart() error {
+	i.finished = true
+	i.depth = -1
+	i.clearPeek()
+	i.next = 0
+	if _, err := i.nextRoot(); err != nil {
+		return err
+	}
+
+	i.finished = false
+	return nil
+}
+
+// IterateErr is like Iterate, but an error returned by Next is sent on the
+// error channel before closing the nodes channel, so it can be checked once the
+// loop over the nodes ends. The error channel is closed after the nodes one,
+// without any error if the iteration finished normally.
+func (i *Iterator) IterateErr() (<-chan *uast.Node, <-chan error) {
+	c := make(chan *uast.Node)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(c)
+		for {
+			n, err := i.Next()
+			if err != nil {
+				errc <- err
+				return
+			}
+
+			if n == nil {
+				return
+			}
+
+			select {
+			case c <- n:
+			case <-i.done:
+				return
+			}
+		}
+	}()
+
+	return c, errc
+}
+
+// ForEachCtx calls fn with every remaining node of the traversal, stopping at
+// the first error returned by fn, which is returned. It gives up returning
+// ctx.Err() once `ctx` is done, which is checked before every step of the
+// traversal: a single step runs in a cgo call that cannot be interrupted.
+func (i *Iterator) ForEachCtx(ctx context.Context, fn func(*uast.Node) error) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := i.Next()
+		if err != nil {
+			return err
+		}
+
+		if n == nil {
+			return nil
+		}
+
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+}
+
+// ToSlice consumes the iterator returning all its remaining nodes in traversal
+// order, so they can be processed without the iterator and its lock, e.g. by
+// several goroutines. It materializes the whole traversal in memory. An error
+// is returned if the iterator had already finished or it is disposed before
+// finishing.
+func (i *Iterator) ToSlice() ([]*uast.Node, error) {
+	var nodes []*uast.Node
+	for {
+		n, err := i.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if n == nil {
+			return nodes, nil
+		}
+		nodes = append(nodes, n)
+	}
+}
+
 // Dispose must be called once you've finished using the iterator or preventively
-// with `defer` to free the iterator resources. Failing to do so would produce
-// a memory leak.
+// with `defer` to free the iterator resources. Failing to do so keeps them until
+// the iterator is garbage collected, which may happen much later or never if
+// there is no pressure on the Go heap, since it does not account for the native
+// memory of the iterator. It also stops the goroutines of Iterate and IterateErr whose
+// channels were not drained; such a channel is closed without the remaining
+// nodes.
 func (i *Iterator) Dispose() {
-	itMutex.Lock()
-	defer itMutex.Unlock()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	runtime.SetFinalizer(i, nil)
 
 	if i.iterPtr != 0 {
 		C.IteratorFree(i.iterPtr)
 		i.iterPtr = 0
 	}
+	if i.table != nil {
+		i.table.release()
+		i.table = nil
+	}
+	if !i.disposed && i.done != nil {
+		close(i.done)
+		atomic.AddInt64(&liveIterators, -1)
+	}
+	i.disposed = true
 	i.finished = true
-	i.root = nil
+	i.roots = nil
+	i.depth = -1
+	i.clearPeek()
+	i.reversed = nil
 }
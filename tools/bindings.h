@@ -1,9 +1,10 @@
 #ifndef CLIENT_GO_BINDINGS_H_
 #define CLIENT_GO_BINDINGS_H_
 
-#include <stdbool.h>
-#include <stdint.h>
-#include <stdlib.h>
+// The libuast state and the calls using it. It must only be included by
+// bindings.go, so there is a single copy of its static variables.
+
+#include "nodes_go.h"
 
 #if __has_include("uast.h") // std C++17, GCC 5.x || Clang || VSC++ 2015u2+
 // Embedded mode on UNIX, MSVC build on Windows.
@@ -13,114 +14,10 @@
 #include "libuast/uast.h"
 #endif
 
-extern char* goGetInternalType(uintptr_t);
-extern char* goGetToken(uintptr_t);
-extern int goGetChildrenSize(uintptr_t);
-extern uintptr_t goGetChild(uintptr_t, int);
-extern int goGetRolesSize(uintptr_t);
-extern uint16_t goGetRole(uintptr_t, int);
-extern int goGetPropertiesSize(uintptr_t);
-extern char* goGetPropertyKey(uintptr_t, int);
-extern char* goGetPropertyValue(uintptr_t, int);
-extern bool goHasStartOffset(uintptr_t);
-extern uint32_t goGetStartOffset(uintptr_t);
-extern bool goHasStartLine(uintptr_t);
-extern uint32_t goGetStartLine(uintptr_t);
-extern bool goHasStartCol(uintptr_t);
-extern uint32_t goGetStartCol(uintptr_t);
-extern bool goHasEndOffset(uintptr_t);
-extern uint32_t goGetEndOffset(uintptr_t);
-extern bool goHasEndLine(uintptr_t);
-extern uint32_t goGetEndLine(uintptr_t);
-extern bool goHasEndCol(uintptr_t);
-extern uint32_t goGetEndCol(uintptr_t);
-
-static const char *InternalType(const void *node) {
-  return goGetInternalType((uintptr_t)node);
-}
-
-static const char *Token(const void *node) {
-  return goGetToken((uintptr_t)node);
-}
-
-static size_t ChildrenSize(const void *node) {
-  return goGetChildrenSize((uintptr_t)node);
-}
-
-static void *ChildAt(const void *data, int index) {
-  return (void*)goGetChild((uintptr_t)data, index);
-}
-
-static size_t RolesSize(const void *node) {
-  return goGetRolesSize((uintptr_t)node);
-}
-
-static uint16_t RoleAt(const void *node, int index) {
-  return goGetRole((uintptr_t)node, index);
-}
-
-static size_t PropertiesSize(const void *node) {
-  return goGetPropertiesSize((uintptr_t)node);
-}
-
-static const char *PropertyKeyAt(const void *node, int index) {
-  return goGetPropertyKey((uintptr_t)node, index);
-}
-
-static const char *PropertyValueAt(const void *node, int index) {
-  return goGetPropertyValue((uintptr_t)node, index);
-}
-
-static bool HasStartOffset(const void *node) {
-  return goHasStartOffset((uintptr_t)node);
-}
-
-static uint32_t StartOffset(const void *node) {
-  return goGetStartOffset((uintptr_t)node);
-}
-
-static bool HasStartLine(const void *node) {
-  return goHasStartLine((uintptr_t)node);
-}
-
-static uint32_t StartLine(const void *node) {
-  return goGetStartLine((uintptr_t)node);
-}
-
-static bool HasStartCol(const void *node) {
-  return goHasStartCol((uintptr_t)node);
-}
-
-static uint32_t StartCol(const void *node) {
-  return goGetStartCol((uintptr_t)node);
-}
-
-static bool HasEndOffset(const void *node) {
-  return goHasEndOffset((uintptr_t)node);
-}
-
-static uint32_t EndOffset(const void *node) {
-  return goGetEndOffset((uintptr_t)node);
-}
-
-static bool HasEndLine(const void *node) {
-  return goHasEndLine((uintptr_t)node);
-}
-
-static uint32_t EndLine(const void *node) {
-  return goGetEndLine((uintptr_t)node);
-}
-
-static bool HasEndCol(const void *node) {
-  return goHasEndCol((uintptr_t)node);
-}
-
-static uint32_t EndCol(const void *node) {
-  return goGetEndCol((uintptr_t)node);
-}
-
+// The Uast only holds the node interface, so it is shared by all the contexts.
+// It is only freed by CloseUast, since UastFree also cleans up the global
+// libxml2 state.
 static Uast *ctx;
-static Nodes *nodes;
 
 static void CreateUast() {
   ctx = UastNew((NodeIface){
@@ -148,14 +45,31 @@ static void CreateUast() {
   });
 }
 
-static bool Filter(uintptr_t node_ptr, const char *query) {
-  nodes = UastFilter(ctx, (void*)node_ptr, query);
-  return nodes != NULL;
+static void FreeUast() {
+  UastFree(ctx);
+  ctx = NULL;
+}
+
+// xpath_error is the LastXPathError of the last libuast query, which like the
+// libuast error message is only meaningful under the exclusive lock.
+static int xpath_error = -1;
+
+static int XPathError() {
+  return xpath_error;
+}
+
+static Nodes *Filter(uintptr_t node_ptr, const char *query) {
+  xmlResetLastError();
+  Nodes *nodes = UastFilter(ctx, (void*)node_ptr, query);
+  xpath_error = LastXPathError();
+  return nodes;
 }
 
 static int FilterBool(uintptr_t node_ptr, const char *query) {
   bool ok;
+  xmlResetLastError();
   bool res = UastFilterBool(ctx, (void*)node_ptr, query, &ok);
+  xpath_error = LastXPathError();
   if (!ok) {
     return -1;
   }
@@ -164,7 +78,9 @@ static int FilterBool(uintptr_t node_ptr, const char *query) {
 
 static double FilterNumber(uintptr_t node_ptr, const char *query, int *ok) {
   bool c_ok;
+  xmlResetLastError();
   double res = UastFilterNumber(ctx, (void*)node_ptr, query, &c_ok);
+  xpath_error = LastXPathError();
   if (!c_ok) {
     *ok = 0;
   } else {
@@ -174,7 +90,10 @@ static double FilterNumber(uintptr_t node_ptr, const char *query, int *ok) {
 }
 
 static const char *FilterString(uintptr_t node_ptr, const char *query) {
-  return UastFilterString(ctx, (void*)node_ptr, query);
+  xmlResetLastError();
+  const char *res = UastFilterString(ctx, (void*)node_ptr, query);
+  xpath_error = LastXPathError();
+  return res;
 }
 
 static uintptr_t IteratorNew(uintptr_t node_ptr, int order) {
@@ -189,15 +108,69 @@ static void IteratorFree(uintptr_t iter) {
   UastIteratorFree((void*)iter);
 }
 
+static int CountNodes(uintptr_t node_ptr) {
+  UastIterator *iter = UastIteratorNew(ctx, (void*)node_ptr, PRE_ORDER);
+  if (!iter) {
+    return -1;
+  }
+
+  int count = 0;
+  while (UastIteratorNext(iter) != NULL) {
+    count++;
+  }
+  UastIteratorFree(iter);
+  return count;
+}
+
+static int CountTokens(uintptr_t node_ptr, int *total) {
+  *total = 0;
+  UastIterator *iter = UastIteratorNew(ctx, (void*)node_ptr, PRE_ORDER);
+  if (!iter) {
+    return -1;
+  }
+
+  // Skip the root, only descendants are counted
+  UastIteratorNext(iter);
+
+  int tokens = 0;
+  void *node;
+  while ((node = UastIteratorNext(iter)) != NULL) {
+    (*total)++;
+    if (goHasToken((uintptr_t)node)) {
+      tokens++;
+    }
+  }
+  UastIteratorFree(iter);
+  return tokens;
+}
+
+static int SameTokenNodes(uintptr_t node_ptr, uintptr_t target_ptr,
+                          uintptr_t *results, int size) {
+  UastIterator *iter = UastIteratorNew(ctx, (void*)node_ptr, PRE_ORDER);
+  if (!iter) {
+    return -1;
+  }
+
+  int count = 0;
+  void *node;
+  while ((node = UastIteratorNext(iter)) != NULL && count < size) {
+    if (goHasSameToken((uintptr_t)node, target_ptr)) {
+      results[count++] = (uintptr_t)node;
+    }
+  }
+  UastIteratorFree(iter);
+  return count;
+}
+
 static char *Error() {
   return LastError();
 }
 
-static int Size() {
+static int Size(const Nodes *nodes) {
   return NodesSize(nodes);
 }
 
-static uintptr_t At(int i) {
+static uintptr_t At(const Nodes *nodes, int i) {
   return (uintptr_t)NodeAt(nodes, i);
 }
 
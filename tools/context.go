@@ -0,0 +1,196 @@
+package tools
+
+// #include <stdint.h>
+import "C"
+
+import (
+	"sync"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// The nodes are not given to libuast as Go pointers, which C code is not
+// allowed to keep, but as handles: the slot of the node table in use by the
+// call (or iterator) in the upper bits and the 1-based index of the node in
+// that table in the lower ones. Tables are only read from the callbacks, which
+// run in the goroutine that made the call, so a table needs no locking as long
+// as it is not used by two calls at the same time.
+//
+// Since the table references every node handed to C until it is released, the
+// nodes can't be collected during a call nor while an iterator is in use,
+// without pinning them in any other way or disabling the garbage collector.
+//
+// There are maxSlots (4096) slots for the whole process, each one in use by a
+// running query or a live iterator, i.e. one not disposed nor collected yet.
+// Once all of them are in use, the queries and the new iterators fail with an
+// error until some slot is released.
+const (
+	slotBits  = 12
+	maxSlots  = 1 << slotBits
+	indexBits = 32<<(^uintptr(0)>>63) - slotBits
+	indexMask = 1<<indexBits - 1
+)
+
+var (
+	tablesMutex sync.Mutex
+	tables      [maxSlots]*nodeTable
+	freeSlots   []uintptr
+)
+
+func init() {
+	freeSlots = make([]uintptr, maxSlots)
+	for i := range freeSlots {
+		freeSlots[i] = uintptr(maxSlots - 1 - i)
+	}
+}
+
+// nodeTable holds the nodes and C strings handed to libuast during a call.
+type nodeTable struct {
+	slot  uintptr
+	nodes []*uast.Node
+	// depths holds the depth of every node, 0 for the ones added by handle.
+	depths []int
+	// children holds the non-nil children of every node, the only ones given
+	// to libuast, once they are asked for.
+	children [][]*uast.Node
+	pool     cstringPool
+	keys     map[*uast.Node][]string
+
+	// funcs are the XPath functions callable during the call, and funcErr
+	// the error returned by the first of them that failed.
+	funcs   map[string]XPathFunction
+	funcErr error
+
+	// limitDepth tells if the nodes at maxDepth are given to libuast as if
+	// they had no children.
+	limitDepth bool
+	maxDepth   int
+}
+
+// acquire registers the table in a free slot until release is called.
+func (t *nodeTable) acquire() error {
+	tablesMutex.Lock()
+	defer tablesMutex.Unlock()
+
+	if len(freeSlots) == 0 {
+		return &errInternal{Message: "too many concurrent queries and iterators"}
+	}
+
+	t.slot = freeSlots[len(freeSlots)-1]
+	freeSlots = freeSlots[:len(freeSlots)-1]
+	tables[t.slot] = t
+	return nil
+}
+
+// release clears the table and makes its slot available again.
+func (t *nodeTable) release() {
+	t.clear()
+
+	tablesMutex.Lock()
+	tables[t.slot] = nil
+	freeSlots = append(freeSlots, t.slot)
+	tablesMutex.Unlock()
+}
+
+// clear frees the C strings and forgets the nodes of the table, invalidating
+// the handles given until now, but keeps its slot.
+func (t *nodeTable) clear() {
+	t.pool.release()
+	for i := range t.nodes {
+		t.nodes[i] = nil
+	}
+	for i := range t.children {
+		t.children[i] = nil
+	}
+	t.nodes = t.nodes[:0]
+	t.depths = t.depths[:0]
+	t.children = t.children[:0]
+	t.keys = nil
+	t.funcs = nil
+	t.funcErr = nil
+}
+
+// handle adds the node to the table and returns the handle to pass to C, or 0
+// for a nil node.
+func (t *nodeTable) handle(node *uast.Node) C.uintptr_t {
+	return t.add(node, 0)
+}
+
+// childHandle adds a child of the node with the given handle to the table and
+// returns its handle.
+func (t *nodeTable) childHandle(parent C.uintptr_t, child *uast.Node) C.uintptr_t {
+	return t.add(child, t.depths[uintptr(parent)&indexMask-1]+1)
+}
+
+func (t *nodeTable) add(node *uast.Node, depth int) C.uintptr_t {
+	if node == nil {
+		return 0
+	}
+
+	t.nodes = append(t.nodes, node)
+	t.depths = append(t.depths, depth)
+	t.children = append(t.children, nil)
+	if len(t.nodes) > indexMask {
+		panic("too many nodes in a single call")
+	}
+	return C.uintptr_t(t.slot<<indexBits | uintptr(len(t.nodes)))
+}
+
+func tableOf(ptr C.uintptr_t) *nodeTable {
+	return tables[uintptr(ptr)>>indexBits]
+}
+
+func ptrToNode(ptr C.uintptr_t) *uast.Node {
+	return tableOf(ptr).nodes[uintptr(ptr)&indexMask-1]
+}
+
+func ptrToDepth(ptr C.uintptr_t) int {
+	return tableOf(ptr).depths[uintptr(ptr)&indexMask-1]
+}
+
+// ptrToChildren returns the non-nil children of the node with the given
+// handle, which libuast sees as its only children.
+func ptrToChildren(ptr C.uintptr_t) []*uast.Node {
+	t, i := tableOf(ptr), uintptr(ptr)&indexMask-1
+	if t.children[i] == nil {
+		t.children[i] = nonNilChildren(t.nodes[i])
+	}
+	return t.children[i]
+}
+
+// Context runs queries with its own state, so queries on different contexts
+// can run concurrently. The queries on the same context are serialized, as the
+// package level functions are, which use a default context. Up to 4096 queries
+// and iterators can be in use at the same time in the process, counting the
+// ones of all the contexts; beyond that, they fail with an error saying there
+// are too many concurrent queries and iterators.
+type Context struct {
+	mu    sync.Mutex
+	table nodeTable
+}
+
+var defaultContext = NewContext()
+
+// NewContext returns a new Context ready to use.
+func NewContext() *Context {
+	return &Context{}
+}
+
+// init converts the query string and node to C types. It locks the context
+// and acquires its node table. The caller should defer returned function to
+// release the resources.
+func (c *Context) init(node *uast.Node, xpath string) (*C.char, C.uintptr_t, func(), error) {
+	c.mu.Lock()
+	if err := c.table.acquire(); err != nil {
+		c.mu.Unlock()
+		return nil, 0, nil, err
+	}
+
+	cquery := c.table.pool.getCstring(xpath)
+	ptr := c.table.handle(node)
+
+	return cquery, ptr, func() {
+		c.table.release()
+		c.mu.Unlock()
+	}, nil
+}
@@ -0,0 +1,432 @@
+package tools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// CorpusError is returned by the corpus functions when the query failed on
+// some of the trees. It maps the name of every failing tree to its error.
+type CorpusError map[string]error
+
+func (e CorpusError) Error() string {
+	if len(e) == 0 {
+		return "corpus error"
+	}
+
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, e[name])
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// ErrDeadlineReached is returned by FilterCorpusDeadline when the deadline
+// passed before all the trees were filtered.
+type ErrDeadlineReached struct {
+	// Skipped are the names of the trees that were not filtered, sorted.
+	Skipped []string
+	// Failed holds the errors of the trees that were filtered but failed.
+	Failed CorpusError
+}
+
+func (e *ErrDeadlineReached) Error() string {
+	msg := fmt.Sprintf("deadline reached, %d trees skipped: %s",
+		len(e.Skipped), strings.Join(e.Skipped, ", "))
+	if len(e.Failed) > 0 {
+		msg += "\n" + e.Failed.Error()
+	}
+	return msg
+}
+
+// FilterCorpus runs the xpath query over every tree in `roots`, spreading the
+// work across `workers` goroutines (runtime.NumCPU() if `workers` <= 0). Each
+// goroutine compiles the query once, with Prepare, for all the trees it
+// filters, so the trees are filtered in parallel and without parsing the query
+// again. It returns the results keyed by the same names as `roots`. A failure
+// on a tree does not stop the others: the results of the trees that succeeded
+// are returned together with a CorpusError holding the failures.
+func FilterCorpus(roots map[string]*uast.Node, xpath string, workers int) (map[string][]*uast.Node, error) {
+	var mu sync.Mutex
+	results := make(map[string][]*uast.Node, len(roots))
+	err := forEachTree(roots, xpath, workers, func(q *workerQuery, name string, node *uast.Node) error {
+		nodes, err := q.filter(node)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		results[name] = nodes
+		mu.Unlock()
+		return nil
+	})
+	return results, err
+}
+
+// CountCorpus returns the number of nodes matching the xpath query in every
+// tree of `roots`, keyed by the same names. The matches are counted without
+// building the list of result nodes. As in FilterCorpus, the trees are
+// filtered in parallel, from runtime.NumCPU() goroutines, each one compiling
+// the query once. A failure on a tree does not stop the others: the counts of
+// the trees that succeeded are returned together with a CorpusError holding
+// the failures.
+func CountCorpus(roots map[string]*uast.Node, xpath string) (map[string]int, error) {
+	var mu sync.Mutex
+	counts := make(map[string]int, len(roots))
+	err := forEachTree(roots, xpath, 0, func(q *workerQuery, name string, node *uast.Node) error {
+		count, err := q.count(node)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		counts[name] = count
+		mu.Unlock()
+		return nil
+	})
+	return counts, err
+}
+
+// TreesError is returned by FilterMany and FilterEach when the query failed on
+// some of the trees. It maps the index of every failing tree to its error.
+type TreesError map[int]error
+
+func (e TreesError) Error() string {
+	if len(e) == 0 {
+		return "trees error"
+	}
+
+	indexes := make([]int, 0, len(e))
+	for i := range e {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	msgs := make([]string, len(indexes))
+	for j, i := range indexes {
+		msgs[j] = fmt.Sprintf("tree %d: %s", i, e[i])
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// FilterMany runs the xpath query over every tree of `trees` from `workers`
+// goroutines (runtime.NumCPU() if `workers` <= 0), each one with its own
+// Context, so the trees are actually filtered in parallel. The results are
+// returned in the same order as the trees. A failure on a tree does not stop
+// the others: its result is nil and its error is returned, together with the
+// other results, in a TreesError.
+func FilterMany(trees []*uast.Node, xpath string, workers int) ([][]*uast.Node, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	indexes := make(chan int)
+	go func() {
+		for i := range trees {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		errs    = make(TreesError)
+		results = make([][]*uast.Node, len(trees))
+	)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := NewContext()
+			for i := range indexes {
+				nodes, err := ctx.Filter(trees[i], xpath)
+				if err != nil {
+					mu.Lock()
+					errs[i] = err
+					mu.Unlock()
+					continue
+				}
+				results[i] = nodes
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+// FilterEach runs the xpath query over the subtree rooted at each of `nodes`,
+// usually the results of a previous query, and returns the matches keyed by
+// the node they were found under. The query is relative to each node as it
+// is for Filter, where the node is the root of the document, so `//Return`
+// finds the Return nodes under it. The nil nodes are skipped. A failure on a
+// node does not stop the others: it is not in the map and its error is
+// returned, keyed by its index in `nodes`, in a TreesError.
+// FilterEach is thread-safe but not concurrent by an internal global lock.
+func FilterEach(nodes []*uast.Node, xpath string) (map[*uast.Node][]*uast.Node, error) {
+	results := make(map[*uast.Node][]*uast.Node, len(nodes))
+	errs := make(TreesError)
+	for i, n := range nodes {
+		if n == nil {
+			continue
+		}
+
+		if _, ok := results[n]; ok {
+			continue
+		}
+
+		matches, err := Filter(n, xpath)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		results[n] = matches
+	}
+
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+// workerQuery is the xpath query of a goroutine filtering many trees, prepared
+// once for all of them. The goroutines need a query each, since a
+// PreparedQuery runs over a single tree at a time.
+type workerQuery struct {
+	q   *PreparedQuery
+	err error
+}
+
+// newWorkerQuery prepares the query. An error compiling it is returned by
+// every call, as the package level functions would do for every tree.
+func newWorkerQuery(xpath string) *workerQuery {
+	if len(xpath) == 0 {
+		return &workerQuery{}
+	}
+
+	q, err := Prepare(xpath)
+	return &workerQuery{q: q, err: err}
+}
+
+// filter is the package level Filter function with the query.
+func (w *workerQuery) filter(node *uast.Node) ([]*uast.Node, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	if w.q == nil {
+		return nil, nil
+	}
+	return w.q.Filter(node)
+}
+
+// count is the package level FilterCount function with the query.
+func (w *workerQuery) count(node *uast.Node) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.q == nil {
+		return 0, nil
+	}
+	return w.q.count(node)
+}
+
+func (w *workerQuery) close() {
+	if w.q != nil {
+		w.q.Close()
+	}
+}
+
+// forEachTree calls fn for every tree of roots from `workers` goroutines
+// (runtime.NumCPU() if `workers` <= 0), each one with its own workerQuery for
+// the xpath query, returning a CorpusError with the errors returned by fn, if
+// any.
+func forEachTree(roots map[string]*uast.Node, xpath string, workers int, fn func(q *workerQuery, name string, node *uast.Node) error) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(roots) {
+		workers = len(roots)
+	}
+
+	names := make(chan string)
+	go func() {
+		for name := range roots {
+			names <- name
+		}
+		close(names)
+	}()
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs = make(CorpusError)
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := newWorkerQuery(xpath)
+			defer q.close()
+			for name := range names {
+				if err := fn(q, name, roots[name]); err != nil {
+					mu.Lock()
+					errs[name] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// FilterFiles reads, one by one, the protobuf serialized UASTs stored in
+// `paths`, filters them with the xpath query and calls `fn` with the results
+// or the error found reading or filtering each file. Only one tree is kept in
+// memory at a time. It returns a CorpusError with the failing files, if any.
+// FilterFilesConcurrent does the same from many goroutines.
+func FilterFiles(paths []string, xpath string, fn func(path string, results []*uast.Node, err error)) error {
+	errs := make(CorpusError)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		var nodes []*uast.Node
+		if err == nil {
+			nodes, err = FilterBytes(data, xpath)
+		}
+
+		if err != nil {
+			errs[path] = err
+		}
+		fn(path, nodes, err)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// FilterFilesConcurrent is like FilterFiles but the files are read and
+// filtered from `workers` goroutines (runtime.NumCPU() if `workers` <= 0),
+// each one compiling the query once, as FilterCorpus does. Only one tree per
+// goroutine is kept in memory at a time. The calls to `fn` are serialized, so
+// it needs no locking, but they are made in no particular order.
+func FilterFilesConcurrent(paths []string, xpath string, workers int, fn func(path string, results []*uast.Node, err error)) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+
+	queue := make(chan string)
+	go func() {
+		for _, path := range paths {
+			queue <- path
+		}
+		close(queue)
+	}()
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs = make(CorpusError)
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := newWorkerQuery(xpath)
+			defer q.close()
+			for path := range queue {
+				nodes, err := filterFile(q, path)
+
+				mu.Lock()
+				if err != nil {
+					errs[path] = err
+				}
+				fn(path, nodes, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// filterFile reads and decodes the tree stored in path and filters it with
+// the query.
+func filterFile(q *workerQuery, path string) ([]*uast.Node, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &uast.Node{}
+	if err := node.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return q.filter(node)
+}
+
+// FilterCorpusDeadline runs the xpath query over the trees in `roots`, sorted
+// by name, until the deadline passes. The deadline is checked before filtering
+// every tree, so a query that already started is not interrupted. If the
+// deadline is reached it returns the results obtained so far together with an
+// *ErrDeadlineReached listing the skipped trees; otherwise, failures are
+// reported as in FilterCorpus.
+func FilterCorpusDeadline(roots map[string]*uast.Node, xpath string, deadline time.Time) (map[string][]*uast.Node, error) {
+	names := make([]string, 0, len(roots))
+	for name := range roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make(map[string][]*uast.Node, len(roots))
+	errs := make(CorpusError)
+	for i, name := range names {
+		if time.Now().After(deadline) {
+			return results, &ErrDeadlineReached{Skipped: names[i:], Failed: errs}
+		}
+
+		nodes, err := Filter(roots[name], xpath)
+		if err != nil {
+			errs[name] = err
+		} else {
+			results[name] = nodes
+		}
+	}
+
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
@@ -0,0 +1,225 @@
+package tools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+func corpus() map[string]*uast.Node {
+	return map[string]*uast.Node{
+		"a.py": nodeTree(),
+		"b.py": {InternalType: "child1"},
+		"c.py": {InternalType: "other"},
+	}
+}
+
+func TestFilterCorpus(t *testing.T) {
+	r, err := FilterCorpus(corpus(), "//child1", 2)
+	assert.Nil(t, err)
+	assert.Len(t, r, 3)
+	assert.Len(t, r["a.py"], 1)
+	assert.Len(t, r["b.py"], 1)
+	assert.Len(t, r["c.py"], 0)
+}
+
+func TestFilterCorpus_Parallel(t *testing.T) {
+	// the workers must not wait for the queries of the default context
+	defaultContext.mu.Lock()
+	defer defaultContext.mu.Unlock()
+
+	r, err := FilterCorpus(corpus(), "//child1", 3)
+	assert.Nil(t, err)
+	assert.Len(t, r["a.py"], 1)
+	assert.Len(t, r["b.py"], 1)
+	assert.Len(t, r["c.py"], 0)
+
+	r, err = FilterCorpus(corpus(), "", 2)
+	assert.Nil(t, err)
+	assert.Len(t, r, 3)
+	assert.Len(t, r["a.py"], 0)
+}
+
+func TestFilterCorpus_Error(t *testing.T) {
+	r, err := FilterCorpus(corpus(), ":", 0)
+	assert.Len(t, r, 0)
+
+	cerr, ok := err.(CorpusError)
+	assert.True(t, ok)
+	assert.Len(t, cerr, 3)
+	assert.IsType(t, &FilterError{}, cerr["a.py"])
+}
+
+func TestFilterMany(t *testing.T) {
+	trees := []*uast.Node{nodeTree(), {InternalType: "child1"}, nil, {InternalType: "other"}}
+	for i := 0; i < 50; i++ {
+		trees = append(trees, nodeTree())
+	}
+
+	r, err := FilterMany(trees, "//child1", 4)
+	assert.Nil(t, err)
+	assert.Len(t, r, len(trees))
+	assert.Equal(t, []*uast.Node{trees[0].Children[0]}, r[0])
+	assert.Equal(t, []*uast.Node{trees[1]}, r[1])
+	assert.Len(t, r[2], 0)
+	assert.Len(t, r[3], 0)
+	for i := 4; i < len(trees); i++ {
+		assert.Equal(t, []*uast.Node{trees[i].Children[0]}, r[i])
+	}
+
+	r, err = FilterMany(trees[:2], ":", 0)
+	assert.Equal(t, [][]*uast.Node{nil, nil}, r)
+	terr, ok := err.(TreesError)
+	assert.True(t, ok)
+	assert.Len(t, terr, 2)
+	assert.IsType(t, &FilterError{}, terr[1])
+
+	r, err = FilterMany(nil, "//*", 2)
+	assert.Nil(t, err)
+	assert.Len(t, r, 0)
+}
+
+func TestFilterEach(t *testing.T) {
+	n := nodeTree()
+	child1, child2 := n.Children[0], n.Children[1]
+
+	r, err := FilterEach([]*uast.Node{child1, nil, child2, child2}, "//*[starts-with(name(), 'sub')]")
+	assert.Nil(t, err)
+	assert.Equal(t, map[*uast.Node][]*uast.Node{
+		child1: {},
+		child2: child2.Children,
+	}, r)
+
+	r, err = FilterEach([]*uast.Node{nil, child1}, "//*[")
+	assert.Len(t, r, 0)
+	terr, ok := err.(TreesError)
+	assert.True(t, ok)
+	assert.Len(t, terr, 1)
+	assert.IsType(t, &FilterError{}, terr[1])
+	assert.Contains(t, terr.Error(), "tree 1: ")
+}
+
+func TestFilterFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "corpus")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for _, name := range []string{"a.py", "b.py"} {
+		data, err := corpus()[name].Marshal()
+		assert.Nil(t, err)
+		path := filepath.Join(dir, name)
+		assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+		paths = append(paths, path)
+	}
+	missing := filepath.Join(dir, "missing")
+	paths = append(paths, missing)
+
+	seen := make(map[string]int)
+	err = FilterFiles(paths, "//*", func(path string, results []*uast.Node, err error) {
+		if path == missing {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		seen[filepath.Base(path)] = len(results)
+	})
+
+	assert.Equal(t, map[string]int{"a.py": 5, "b.py": 1, "missing": 0}, seen)
+	cerr, ok := err.(CorpusError)
+	assert.True(t, ok)
+	assert.Len(t, cerr, 1)
+	assert.NotNil(t, cerr[missing])
+}
+
+func TestFilterFilesConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "corpus")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	expected := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		for name, n := range corpus() {
+			data, err := n.Marshal()
+			assert.Nil(t, err)
+			path := filepath.Join(dir, fmt.Sprintf("%d_%s", i, name))
+			assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+			paths = append(paths, path)
+			expected[path] = map[string]int{"a.py": 5, "b.py": 1, "c.py": 1}[name]
+		}
+	}
+
+	missing := filepath.Join(dir, "missing")
+	corrupt := filepath.Join(dir, "corrupt")
+	assert.Nil(t, ioutil.WriteFile(corrupt, []byte{0xff}, 0644))
+	paths = append(paths, missing, corrupt)
+	expected[missing] = 0
+	expected[corrupt] = 0
+
+	// the workers must not wait for the queries of the default context
+	defaultContext.mu.Lock()
+	defer defaultContext.mu.Unlock()
+
+	seen := make(map[string]int)
+	err = FilterFilesConcurrent(paths, "//*", 4, func(path string, results []*uast.Node, err error) {
+		if path == missing || path == corrupt {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		seen[path] = len(results)
+	})
+
+	assert.Equal(t, expected, seen)
+	cerr, ok := err.(CorpusError)
+	assert.True(t, ok)
+	assert.Len(t, cerr, 2)
+	assert.NotNil(t, cerr[missing])
+	assert.NotNil(t, cerr[corrupt])
+
+	err = FilterFilesConcurrent(paths[:3], ":", 0, func(path string, results []*uast.Node, err error) {
+		assert.IsType(t, &FilterError{}, err)
+	})
+	cerr, ok = err.(CorpusError)
+	assert.True(t, ok)
+	assert.Len(t, cerr, 3)
+}
+
+func TestFilterCorpusDeadline(t *testing.T) {
+	r, err := FilterCorpusDeadline(corpus(), "//child1", time.Now().Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Len(t, r, 3)
+	assert.Len(t, r["a.py"], 1)
+
+	r, err = FilterCorpusDeadline(corpus(), "//child1", time.Now().Add(-time.Second))
+	assert.Len(t, r, 0)
+	derr, ok := err.(*ErrDeadlineReached)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a.py", "b.py", "c.py"}, derr.Skipped)
+}
+
+func TestCountCorpus(t *testing.T) {
+	r, err := CountCorpus(corpus(), "//*")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"a.py": 5, "b.py": 1, "c.py": 1}, r)
+
+	r, err = CountCorpus(corpus(), ":")
+	assert.Len(t, r, 0)
+	assert.Len(t, err, 3)
+}
+
+func TestCountCorpus_Parallel(t *testing.T) {
+	defaultContext.mu.Lock()
+	defer defaultContext.mu.Unlock()
+
+	r, err := CountCorpus(corpus(), "//child1")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"a.py": 1, "b.py": 1, "c.py": 0}, r)
+}
@@ -2,15 +2,26 @@ package tools
 
 // #include <stdlib.h>
 import "C"
-import "unsafe"
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// pooledStrings and pooledBytes are the number and total size of the C
+// strings held by all the pools.
+var pooledStrings, pooledBytes int64
 
 type cstringPool struct {
 	pointers []unsafe.Pointer
+	bytes    int64
 }
 
 func (pool *cstringPool) getCstring(str string) *C.char {
 	ptr := C.CString(str)
 	pool.pointers = append(pool.pointers, unsafe.Pointer(ptr))
+	pool.bytes += int64(len(str) + 1)
+	atomic.AddInt64(&pooledStrings, 1)
+	atomic.AddInt64(&pooledBytes, int64(len(str)+1))
 	return ptr
 }
 
@@ -18,5 +29,41 @@ func (pool *cstringPool) release() {
 	for _, ptr := range pool.pointers {
 		C.free(ptr)
 	}
+	atomic.AddInt64(&pooledStrings, -int64(len(pool.pointers)))
+	atomic.AddInt64(&pooledBytes, -pool.bytes)
 	pool.pointers = pool.pointers[:0]
+	pool.bytes = 0
+}
+
+// PoolStats returns the number of C strings handed to libuast that are still
+// allocated, and their total size in bytes, over all the running queries and
+// the iterators not disposed. The strings of a query are freed once it ends,
+// and the ones of an iterator once it is disposed.
+func PoolStats() (count int, bytes int) {
+	return int(atomic.LoadInt64(&pooledStrings)), int(atomic.LoadInt64(&pooledBytes))
+}
+
+// ResetPool frees the strings and the buffers kept by the node table of the
+// package level functions, which are reused by their next queries, so the
+// memory taken by a query over a large tree is not retained once it ends. It
+// takes the libuast write lock, so it waits for the running libuast calls, and
+// it does nothing if a query of the package level functions is running. The
+// pools of the running queries and of the iterators not disposed are never
+// freed, since libuast may still use their strings; the pools of the queries
+// of a Context or a PreparedQuery are freed once they end.
+func ResetPool() {
+	lockUast()
+	defer uastMutex.Unlock()
+
+	c := defaultContext
+	if !c.mu.TryLock() {
+		return
+	}
+	defer c.mu.Unlock()
+
+	c.table.pool.release()
+	c.table.pool.pointers = nil
+	c.table.nodes = nil
+	c.table.depths = nil
+	c.table.children = nil
 }
@@ -0,0 +1,195 @@
+package tools
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// ChangeOp is the kind of a Change found by Diff.
+type ChangeOp int
+
+const (
+	// Added is a subtree only present in the new tree.
+	Added ChangeOp = iota
+	// Removed is a subtree only present in the old tree.
+	Removed
+	// Modified is a node present in both trees with a different internal
+	// type, token, roles or properties. Its children are compared apart.
+	Modified
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case Added:
+		return "Added"
+	case Removed:
+		return "Removed"
+	case Modified:
+		return "Modified"
+	default:
+		return "Unknown"
+	}
+}
+
+// Change is a difference between two trees found by Diff. Old is the node of
+// the old tree and New the one of the new tree, nil for an Added or a Removed
+// change respectively.
+type Change struct {
+	Op  ChangeOp
+	Old *uast.Node
+	New *uast.Node
+}
+
+// Diff returns the changes needed to turn the tree rooted at `a` into the one
+// rooted at `b`, in pre-order of the trees, or nil if they are equal ignoring
+// the positions.
+//
+// The trees are matched from the roots down: two nodes can only be matched if
+// they have the same internal type, and a matched pair is reported as Modified
+// when their tokens, roles or properties differ. The children of a matched pair
+// are aligned keeping their order, preferring the pairs of identical subtrees
+// and then as many pairs of the same internal type as possible; the children
+// left unmatched are reported as a single Added or Removed change for their
+// whole subtree. The roots are reported as Removed and Added if their internal
+// types differ.
+//
+// This is a heuristic and not a minimal tree edit script: a node moved to
+// another parent is seen as removed and added, as is a node wrapped in a new
+// one, and siblings of the same type may be paired differently than a person
+// would. The positions are not compared, since any edit shifts the positions
+// of all the code after it.
+func Diff(a, b *uast.Node) []Change {
+	d := &differ{hashes: make(map[*uast.Node]uint64)}
+	d.diff(a, b)
+	return d.changes
+}
+
+type differ struct {
+	changes []Change
+	hashes  map[*uast.Node]uint64
+}
+
+func (d *differ) diff(a, b *uast.Node) {
+	switch {
+	case a == nil && b == nil:
+		return
+	case a == nil:
+		d.changes = append(d.changes, Change{Op: Added, New: b})
+		return
+	case b == nil:
+		d.changes = append(d.changes, Change{Op: Removed, Old: a})
+		return
+	case a.InternalType != b.InternalType:
+		d.changes = append(d.changes, Change{Op: Removed, Old: a}, Change{Op: Added, New: b})
+		return
+	}
+
+	if !contentEqual(a, b) {
+		d.changes = append(d.changes, Change{Op: Modified, Old: a, New: b})
+	}
+
+	old, new := nonNilChildren(a), nonNilChildren(b)
+	if len(old) == 0 && len(new) == 0 {
+		return
+	}
+
+	// score[i][j] is the best score aligning old[i:] and new[j:], where a pair
+	// of identical subtrees scores 2 and a pair of the same type 1.
+	score := make([][]int, len(old)+1)
+	for i := range score {
+		score[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			s := score[i+1][j]
+			if score[i][j+1] > s {
+				s = score[i][j+1]
+			}
+			if m := d.matchScore(old[i], new[j]); m > 0 && m+score[i+1][j+1] > s {
+				s = m + score[i+1][j+1]
+			}
+			score[i][j] = s
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(old) && j < len(new) {
+		if m := d.matchScore(old[i], new[j]); m > 0 && score[i][j] == m+score[i+1][j+1] {
+			d.diff(old[i], new[j])
+			i++
+			j++
+		} else if score[i][j] == score[i+1][j] {
+			d.diff(old[i], nil)
+			i++
+		} else {
+			d.diff(nil, new[j])
+			j++
+		}
+	}
+	for ; i < len(old); i++ {
+		d.diff(old[i], nil)
+	}
+	for ; j < len(new); j++ {
+		d.diff(nil, new[j])
+	}
+}
+
+// matchScore returns 2 if the subtrees look identical, 1 if their roots have
+// the same internal type and 0 if they can't be matched.
+func (d *differ) matchScore(a, b *uast.Node) int {
+	if a.InternalType != b.InternalType {
+		return 0
+	}
+	if d.hash(a) == d.hash(b) {
+		return 2
+	}
+	return 1
+}
+
+// hash returns a hash of the content of the subtree rooted at node, ignoring
+// the positions. Collisions only make the alignment of Diff worse, the nodes
+// are still compared to report the changes.
+func (d *differ) hash(node *uast.Node) uint64 {
+	if h, ok := d.hashes[node]; ok {
+		return h
+	}
+
+	h := fnv.New64a()
+	var buf [8]byte
+	writeString := func(s string) {
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(s)))
+		h.Write(buf[:])
+		h.Write([]byte(s))
+	}
+
+	writeString(node.InternalType)
+	writeString(node.Token)
+	binary.LittleEndian.PutUint64(buf[:], uint64(len(node.Roles)))
+	h.Write(buf[:])
+	for _, r := range node.Roles {
+		binary.LittleEndian.PutUint64(buf[:], uint64(r))
+		h.Write(buf[:])
+	}
+
+	keys := make([]string, 0, len(node.Properties))
+	for k := range node.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeString(k)
+		writeString(node.Properties[k])
+	}
+
+	for _, child := range nonNilChildren(node) {
+		binary.LittleEndian.PutUint64(buf[:], d.hash(child))
+		h.Write(buf[:])
+	}
+
+	sum := h.Sum64()
+	d.hashes[node] = sum
+	return sum
+}
@@ -0,0 +1,78 @@
+package tools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+func TestDiff_Equal(t *testing.T) {
+	assert.Len(t, Diff(nodeTree(), nodeTree()), 0)
+	assert.Len(t, Diff(nil, nil), 0)
+
+	moved := nodeTree()
+	moved.Children[0].StartPosition = &uast.Position{Offset: 10, Line: 2, Col: 1}
+	assert.Len(t, Diff(nodeTree(), moved), 0)
+}
+
+func TestDiff_AddedChildren(t *testing.T) {
+	old := nodeTree()
+	new := nodeTree()
+	first := &uast.Node{InternalType: "subchild21", Token: "new"}
+	last := &uast.Node{InternalType: "subchild23"}
+	child2 := new.Children[1]
+	child2.Children = append([]*uast.Node{first}, append(child2.Children, last)...)
+
+	assert.Equal(t, []Change{
+		{Op: Added, New: first},
+		{Op: Added, New: last},
+	}, Diff(old, new))
+
+	assert.Equal(t, []Change{{Op: Added, New: new}}, Diff(nil, new))
+}
+
+func TestDiff_RemovedSubtree(t *testing.T) {
+	old := nodeTree()
+	new := nodeTree()
+	new.Children = new.Children[:1]
+
+	assert.Equal(t, []Change{{Op: Removed, Old: old.Children[1]}}, Diff(old, new))
+	assert.Equal(t, []Change{{Op: Removed, Old: old}}, Diff(old, nil))
+}
+
+func TestDiff_TokenChange(t *testing.T) {
+	old := nodeTree()
+	new := nodeTree()
+	new.Children[1].Children[0].Token = "renamed"
+	new.Children[0].Properties = map[string]string{"k": "v"}
+
+	assert.Equal(t, []Change{
+		{Op: Modified, Old: old.Children[0], New: new.Children[0]},
+		{Op: Modified, Old: old.Children[1].Children[0], New: new.Children[1].Children[0]},
+	}, Diff(old, new))
+}
+
+func TestDiff_DifferentTypes(t *testing.T) {
+	old := nodeTree()
+	new := nodeTree()
+	new.Children[0] = &uast.Node{InternalType: "other"}
+
+	assert.Equal(t, []Change{
+		{Op: Removed, Old: old.Children[0]},
+		{Op: Added, New: new.Children[0]},
+	}, Diff(old, new))
+
+	a, b := &uast.Node{InternalType: "a"}, &uast.Node{InternalType: "b"}
+	assert.Equal(t, []Change{{Op: Removed, Old: a}, {Op: Added, New: b}}, Diff(a, b))
+}
+
+func TestDiff_PrefersIdenticalSiblings(t *testing.T) {
+	name := func(token string) *uast.Node {
+		return &uast.Node{InternalType: "Name", Token: token}
+	}
+	old := &uast.Node{InternalType: "List", Children: []*uast.Node{name("a"), name("b"), name("c")}}
+	new := &uast.Node{InternalType: "List", Children: []*uast.Node{name("a"), name("x"), name("b"), name("c")}}
+
+	assert.Equal(t, []Change{{Op: Added, New: new.Children[1]}}, Diff(old, new))
+}
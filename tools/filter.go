@@ -0,0 +1,588 @@
+package tools
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// FilterMarshal takes a `*uast.Node` and a xpath query and filters the tree,
+// returning every matching subtree serialized independently with the protobuf
+// encoding of `uast.Node`. Each entry can be decoded with `(*uast.Node).Unmarshal`
+// and contains the full subtree rooted at the match, including positions,
+// roles and properties.
+// FilterMarshal is thread-safe but not concurrent by an internal global lock.
+func FilterMarshal(node *uast.Node, xpath string) ([][]byte, error) {
+	nodes, err := Filter(node, xpath)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([][]byte, len(nodes))
+	for i, n := range nodes {
+		data, err := n.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		results[i] = data
+	}
+	return results, nil
+}
+
+// FilterBounded works like Filter but does not descend into nodes whose
+// internal type is one of `boundaryTypes`: boundary nodes can be matched
+// themselves, but none of their descendants will. The root node is never
+// considered a boundary, so a query over a function declaration can skip the
+// statements of nested functions. The returned nodes belong to the original
+// tree.
+// FilterBounded is thread-safe but not concurrent by an internal global lock.
+func FilterBounded(node *uast.Node, xpath string, boundaryTypes []string) ([]*uast.Node, error) {
+	if len(boundaryTypes) == 0 || len(xpath) == 0 || node == nil {
+		return Filter(node, xpath)
+	}
+
+	boundaries := make(map[string]bool, len(boundaryTypes))
+	for _, t := range boundaryTypes {
+		boundaries[t] = true
+	}
+
+	origins := make(map[*uast.Node]*uast.Node)
+	pruned := boundedCopy(node, boundaries, origins, true)
+
+	nodes, err := Filter(pruned, xpath)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, n := range nodes {
+		nodes[i] = origins[n]
+	}
+	return nodes, nil
+}
+
+// boundedCopy returns a shallow copy of the tree rooted at node that stops at
+// the boundary types, recording the original node of every copy in origins.
+func boundedCopy(node *uast.Node, boundaries map[string]bool, origins map[*uast.Node]*uast.Node, root bool) *uast.Node {
+	c := *node
+	c.Children = nil
+	origins[&c] = node
+	if !root && boundaries[node.InternalType] {
+		return &c
+	}
+
+	if children := nonNilChildren(node); len(children) > 0 {
+		c.Children = make([]*uast.Node, len(children))
+		for i, child := range children {
+			c.Children[i] = boundedCopy(child, boundaries, origins, false)
+		}
+	}
+	return &c
+}
+
+// FilterByProperty returns, in pre-order, every node under `node` (including
+// itself) having the property `key` set to `value`. It is the equivalent of
+// the query `//*[@key='value']` but it is evaluated in Go looking up the
+// properties map directly, so it does not take the internal global lock.
+func FilterByProperty(node *uast.Node, key, value string) ([]*uast.Node, error) {
+	var results []*uast.Node
+	walkPreOrder(node, func(n *uast.Node) {
+		if v, ok := n.Properties[key]; ok && v == value {
+			results = append(results, n)
+		}
+	})
+	return results, nil
+}
+
+// FilterHasProperty returns, in pre-order, every node under `node` (including
+// itself) having the property `key` set, whatever its value is. Like
+// FilterByProperty, it is evaluated in Go without taking the internal global lock.
+func FilterHasProperty(node *uast.Node, key string) ([]*uast.Node, error) {
+	var results []*uast.Node
+	walkPreOrder(node, func(n *uast.Node) {
+		if _, ok := n.Properties[key]; ok {
+			results = append(results, n)
+		}
+	})
+	return results, nil
+}
+
+// FindByRole returns, in pre-order, every node under `root` (including itself)
+// having the given role. It is the equivalent of the query `//*[@roleX]` for
+// the role X but it is evaluated in Go, so it does not take the internal global
+// lock and it is much faster.
+func FindByRole(root *uast.Node, role uast.Role) []*uast.Node {
+	return FindByRoles(root, role)
+}
+
+// FindByRoles returns, in pre-order, every node under `root` (including
+// itself) having all the given roles, so every node if there are none. Like
+// FindByRole, it is evaluated in Go.
+func FindByRoles(root *uast.Node, roles ...uast.Role) []*uast.Node {
+	var results []*uast.Node
+	walkPreOrder(root, func(n *uast.Node) {
+		for _, role := range roles {
+			if !hasRole(n, role) {
+				return
+			}
+		}
+		results = append(results, n)
+	})
+	return results
+}
+
+// FindByInternalType returns, in pre-order, every node under `root`
+// (including itself) with the given internal type. It is the equivalent of the
+// query `//internalType` but, like FindByRole, it is evaluated in Go.
+func FindByInternalType(root *uast.Node, internalType string) []*uast.Node {
+	var results []*uast.Node
+	walkPreOrder(root, func(n *uast.Node) {
+		if n.InternalType == internalType {
+			results = append(results, n)
+		}
+	})
+	return results
+}
+
+// FindByToken returns, in pre-order, every node under `root` (including
+// itself) whose token is exactly `token`. Like FindByRole, it is evaluated in
+// Go.
+func FindByToken(root *uast.Node, token string) []*uast.Node {
+	return FindByTokenFunc(root, func(t string) bool {
+		return t == token
+	})
+}
+
+// FindByTokenFunc returns, in pre-order, every node under `root` (including
+// itself) whose token satisfies `pred`, e.g. strings.HasPrefix or the
+// MatchString method of a regexp. The nodes without a token are matched
+// against the empty string.
+func FindByTokenFunc(root *uast.Node, pred func(token string) bool) []*uast.Node {
+	var results []*uast.Node
+	walkPreOrder(root, func(n *uast.Node) {
+		if pred(n.Token) {
+			results = append(results, n)
+		}
+	})
+	return results
+}
+
+// ChildrenByRole returns the direct children of the node having the given
+// role, in order. Unlike FindByRole, the descendants of the children are not
+// checked.
+func ChildrenByRole(node *uast.Node, role uast.Role) []*uast.Node {
+	if node == nil {
+		return nil
+	}
+
+	var results []*uast.Node
+	for _, child := range node.Children {
+		if child != nil && hasRole(child, role) {
+			results = append(results, child)
+		}
+	}
+	return results
+}
+
+// FirstChildByRole returns the first direct child of the node having the
+// given role, or nil if there is none.
+func FirstChildByRole(node *uast.Node, role uast.Role) *uast.Node {
+	if node == nil {
+		return nil
+	}
+
+	for _, child := range node.Children {
+		if child != nil && hasRole(child, role) {
+			return child
+		}
+	}
+	return nil
+}
+
+// MapNodes returns a new slice with the result of calling fn with every node
+// of `nodes`, in the same order, nil results included.
+func MapNodes(nodes []*uast.Node, fn func(*uast.Node) *uast.Node) []*uast.Node {
+	if nodes == nil {
+		return nil
+	}
+
+	results := make([]*uast.Node, len(nodes))
+	for i, n := range nodes {
+		results[i] = fn(n)
+	}
+	return results
+}
+
+// FilterNodes returns a new slice with the nodes of `nodes` satisfying `pred`,
+// in the same order. Unlike Filter, it doesn't look at the descendants of the
+// nodes.
+func FilterNodes(nodes []*uast.Node, pred func(*uast.Node) bool) []*uast.Node {
+	var results []*uast.Node
+	for _, n := range nodes {
+		if pred(n) {
+			results = append(results, n)
+		}
+	}
+	return results
+}
+
+// MapTokens returns the token of every node of `nodes`, in the same order, so
+// the result has one element per node: an empty string for the nodes without
+// a token or nil.
+func MapTokens(nodes []*uast.Node) []string {
+	if nodes == nil {
+		return nil
+	}
+
+	tokens := make([]string, len(nodes))
+	for i, n := range nodes {
+		if n != nil {
+			tokens[i] = n.Token
+		}
+	}
+	return tokens
+}
+
+func hasRole(n *uast.Node, role uast.Role) bool {
+	for _, r := range n.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterOrError filters the tree with `xpath` and, only if that query cannot be
+// compiled (a *FilterError of kind SyntaxError), retries with the `fallback` query.
+// The returned bool reports whether the fallback was used. Any other error
+// found evaluating `xpath` is returned as is without trying the fallback, and
+// an error evaluating the fallback is returned along with a true flag.
+// FilterOrError is thread-safe but not concurrent by an internal global lock.
+func FilterOrError(node *uast.Node, xpath, fallback string) ([]*uast.Node, bool, error) {
+	nodes, err := Filter(node, xpath)
+	if !isSyntaxError(err) {
+		return nodes, false, err
+	}
+
+	nodes, err = Filter(node, fallback)
+	return nodes, true, err
+}
+
+// RankedNode is a node returned by FilterRanked along with its score.
+type RankedNode struct {
+	Node  *uast.Node
+	Score float64
+}
+
+// FilterRanked filters the tree with the xpath query and scores every result
+// with `score`, returning them sorted by descending score. The sort is stable:
+// results with the same score keep the XPath document order.
+// FilterRanked is thread-safe but not concurrent by an internal global lock.
+func FilterRanked(node *uast.Node, xpath string, score func(*uast.Node) float64) ([]RankedNode, error) {
+	nodes, err := Filter(node, xpath)
+	if err != nil {
+		return nil, err
+	}
+
+	ranked := make([]RankedNode, len(nodes))
+	for i, n := range nodes {
+		ranked[i] = RankedNode{Node: n, Score: score(n)}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Score > ranked[j].Score
+	})
+	return ranked, nil
+}
+
+// FilterDetached works like Filter but returns a deep copy of every matching
+// subtree. The results do not alias the source tree, which can then be garbage
+// collected while only the matches are retained, and they can be modified or
+// serialized concurrently with the source tree, e.g. to return self-contained
+// fragments to a client. Note that overlapping matches are copied
+// independently.
+// FilterDetached is thread-safe but not concurrent by an internal global lock.
+func FilterDetached(node *uast.Node, xpath string) ([]*uast.Node, error) {
+	nodes, err := Filter(node, xpath)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, n := range nodes {
+		nodes[i] = Clone(n)
+	}
+	return nodes, nil
+}
+
+// FilterSubtrees returns the matching subtrees detached from the source tree,
+// as FilterDetached does.
+func FilterSubtrees(node *uast.Node, xpath string) ([]*uast.Node, error) {
+	return FilterDetached(node, xpath)
+}
+
+// FilterSorted works like Filter but returns the nodes sorted by their start
+// position in the source, as SortByPosition does, instead of in document
+// order.
+// FilterSorted is thread-safe but not concurrent by an internal global lock.
+func FilterSorted(node *uast.Node, xpath string) ([]*uast.Node, error) {
+	nodes, err := Filter(node, xpath)
+	if err != nil {
+		return nil, err
+	}
+
+	SortByPosition(nodes)
+	return nodes, nil
+}
+
+// FilterBytes decodes a protobuf serialized `uast.Node`, like the ones
+// returned by FilterMarshal, and filters it with the xpath query.
+// FilterBytes is thread-safe but not concurrent by an internal global lock.
+func FilterBytes(data []byte, xpath string) ([]*uast.Node, error) {
+	node := &uast.Node{}
+	if err := node.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return Filter(node, xpath)
+}
+
+// MarshalNodes serializes a list of nodes, like the results of Filter, in a
+// single message: the protobuf encoding of a `uast.Node` with the nodes, and
+// their whole subtrees, as its children, which any client with the SDK can
+// decode. UnmarshalNodes is the inverse function. An *ErrInvalidArgument
+// error is returned if any of the nodes is nil.
+func MarshalNodes(nodes []*uast.Node) ([]byte, error) {
+	for _, n := range nodes {
+		if n == nil {
+			return nil, &ErrInvalidArgument{Message: "nil node"}
+		}
+	}
+
+	wrapper := &uast.Node{Children: nodes}
+	return wrapper.Marshal()
+}
+
+// UnmarshalNodes decodes a list of nodes serialized with MarshalNodes.
+func UnmarshalNodes(data []byte) ([]*uast.Node, error) {
+	wrapper := &uast.Node{}
+	if err := wrapper.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return wrapper.Children, nil
+}
+
+// JoinMode is the way FilterPairs matches the results of its two queries.
+type JoinMode int
+
+const (
+	// CartesianJoin pairs every left result with every right result.
+	CartesianJoin JoinMode = iota
+	// ContainmentJoin pairs every left result with the right results that are
+	// its descendants.
+	ContainmentJoin
+	// AdjacentJoin pairs every left result with its next sibling, if it is a
+	// right result.
+	AdjacentJoin
+)
+
+// DefaultMaxPairs is the limit of pairs used by FilterPairs when no positive
+// limit is given.
+const DefaultMaxPairs = 10000
+
+// FilterPairs evaluates `leftXPath` and `rightXPath` over the tree and joins
+// their results with the given mode. Pairs are returned ordered by the left
+// result and then by the right result, both in XPath document order. To guard
+// against combinatorial explosions, an *ErrInvalidArgument error is returned
+// if the join produces more than `limit` pairs (DefaultMaxPairs if `limit` <= 0).
+// FilterPairs is thread-safe but not concurrent by an internal global lock.
+func FilterPairs(node *uast.Node, leftXPath, rightXPath string, mode JoinMode, limit int) ([][2]*uast.Node, error) {
+	if limit <= 0 {
+		limit = DefaultMaxPairs
+	}
+
+	left, err := Filter(node, leftXPath)
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := Filter(node, rightXPath)
+	if err != nil {
+		return nil, err
+	}
+
+	isRight := make(map[*uast.Node]bool, len(right))
+	for _, r := range right {
+		isRight[r] = true
+	}
+
+	var pairs [][2]*uast.Node
+	add := func(l, r *uast.Node) bool {
+		if len(pairs) == limit {
+			return false
+		}
+		pairs = append(pairs, [2]*uast.Node{l, r})
+		return true
+	}
+
+	var parents map[*uast.Node]*uast.Node
+	if mode == AdjacentJoin {
+		parents = Parents(node)
+	}
+
+	exceeded := func() ([][2]*uast.Node, error) {
+		return nil, &ErrInvalidArgument{
+			Message: fmt.Sprintf("join produces more than %d pairs", limit),
+		}
+	}
+
+	for _, l := range left {
+		switch mode {
+		case CartesianJoin:
+			for _, r := range right {
+				if !add(l, r) {
+					return exceeded()
+				}
+			}
+		case ContainmentJoin:
+			ok := true
+			walkPreOrder(l, func(n *uast.Node) {
+				if ok && n != l && isRight[n] {
+					ok = add(l, n)
+				}
+			})
+			if !ok {
+				return exceeded()
+			}
+		case AdjacentJoin:
+			if next := NextSibling(parents, l); next != nil && isRight[next] && !add(l, next) {
+				return exceeded()
+			}
+		default:
+			return nil, &ErrInvalidArgument{Message: fmt.Sprintf("unknown join mode %d", mode)}
+		}
+	}
+	return pairs, nil
+}
+
+// FilterBoundingSpan filters the tree with the xpath query and returns the
+// smallest start offset and the biggest end offset of the matching nodes. Only
+// the nodes having both start and end positions are considered; `ok` is false
+// if there are none or the query fails.
+// FilterBoundingSpan is thread-safe but not concurrent by an internal global lock.
+func FilterBoundingSpan(node *uast.Node, xpath string) (start, end uint32, ok bool) {
+	nodes, err := Filter(node, xpath)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	for _, n := range nodes {
+		if n.StartPosition == nil || n.EndPosition == nil {
+			continue
+		}
+
+		if !ok || n.StartPosition.Offset < start {
+			start = n.StartPosition.Offset
+		}
+		if !ok || n.EndPosition.Offset > end {
+			end = n.EndPosition.Offset
+		}
+		ok = true
+	}
+	return start, end, ok
+}
+
+// FilterText filters the tree with the xpath query and returns the text of
+// `source` covered by every matching node, from its start offset to its end
+// offset. Matches lacking a start or end position, or whose offsets are out of
+// the source range, are skipped, so the results may be fewer than the matches.
+// FilterText is thread-safe but not concurrent by an internal global lock.
+func FilterText(node *uast.Node, xpath string, source []byte) ([]string, error) {
+	nodes, err := Filter(node, xpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var texts []string
+	for _, n := range nodes {
+		if text, ok := SourceSnippet(source, n); ok {
+			texts = append(texts, text)
+		}
+	}
+	return texts, nil
+}
+
+// rootLanguages are the languages of the root constructs of the drivers.
+var rootLanguages = map[string]string{
+	"Module":                "python",
+	"CompilationUnit":       "java",
+	"Program":               "javascript",
+	"SourceFile":            "typescript",
+	"CompilationUnitSyntax": "csharp",
+	"CPPASTTranslationUnit": "cpp",
+}
+
+// Language returns the language of the tree, as named by the drivers (e.g.
+// `python` or `java`), told by its root construct as returned by
+// RootConstruct. It returns an empty string for a root construct of an
+// unknown language.
+func Language(node *uast.Node) string {
+	return rootLanguages[RootConstruct(node)]
+}
+
+// DefaultQuery is the key of the query used by FilterByLanguage for the trees
+// of a language not found in the map.
+const DefaultQuery = "default"
+
+// FilterByLanguage filters the tree with the query of `queries` keyed by the
+// language of the tree, as returned by Language. If there is no query for it,
+// or the language is unknown, the one with the DefaultQuery key is used and,
+// if missing too, an *ErrInvalidArgument error is returned.
+// FilterByLanguage is thread-safe but not concurrent by an internal global lock.
+func FilterByLanguage(node *uast.Node, queries map[string]string) ([]*uast.Node, error) {
+	lang := Language(node)
+	xpath, ok := queries[lang]
+	if !ok || lang == "" {
+		xpath, ok = queries[DefaultQuery]
+	}
+
+	if !ok {
+		return nil, &ErrInvalidArgument{
+			Message: fmt.Sprintf("no query for language %q of root construct %q", lang, RootConstruct(node)),
+		}
+	}
+	return Filter(node, xpath)
+}
+
+// Partition filters the tree with the xpath query and returns both the
+// matching nodes and their siblings that did not match. That is, `unmatched`
+// holds the children of the parents of the matching nodes that are not a match
+// themselves, each one once and ordered by parent and then by position. A
+// matching root node has no siblings.
+// Partition is thread-safe but not concurrent by an internal global lock.
+func Partition(node *uast.Node, xpath string) (matched, unmatched []*uast.Node, err error) {
+	matched, err = Filter(node, xpath)
+	if err != nil || len(matched) == 0 {
+		return matched, nil, err
+	}
+
+	isMatch := make(map[*uast.Node]bool, len(matched))
+	for _, n := range matched {
+		isMatch[n] = true
+	}
+
+	parents := Parents(node)
+	seen := make(map[*uast.Node]bool)
+	for _, n := range matched {
+		parent := parents[n]
+		if parent == nil || seen[parent] {
+			continue
+		}
+		seen[parent] = true
+
+		for _, sibling := range nonNilChildren(parent) {
+			if !isMatch[sibling] {
+				unmatched = append(unmatched, sibling)
+			}
+		}
+	}
+	return matched, unmatched, nil
+}
@@ -1,6 +1,13 @@
 package tools
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -8,6 +15,20 @@ import (
 	"gopkg.in/bblfsh/sdk.v1/uast"
 )
 
+// TestMain frees the libuast state after running the tests, so leak checkers
+// only report the memory actually leaked. It fails if an iterator was not
+// disposed.
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if err := CloseUast(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if code == 0 {
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
+
 func TestFilter(t *testing.T) {
 	n := &uast.Node{}
 
@@ -57,6 +78,329 @@ func TestFilterString(t *testing.T) {
 	assert.Equal(t, r, "TestType")
 }
 
+func TestFilterWithLimit(t *testing.T) {
+	n := nodeTree()
+
+	r, err := FilterWithLimit(n, "//*", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n, n.Children[0]}, r)
+
+	all, err := Filter(n, "//*")
+	assert.Nil(t, err)
+	for _, limit := range []int{0, -1, 5, 10} {
+		r, err = FilterWithLimit(n, "//*", limit)
+		assert.Nil(t, err)
+		assert.Equal(t, all, r, "limit %d", limit)
+	}
+
+	r, err = FilterWithLimit(n, "//child3", 1)
+	assert.Nil(t, err)
+	assert.Len(t, r, 0)
+
+	_, err = FilterWithLimit(n, "//*[", 1)
+	assert.IsType(t, &FilterError{}, err)
+}
+
+func TestFilterInto(t *testing.T) {
+	n := nodeTree()
+	all, err := Filter(n, "//*")
+	assert.Nil(t, err)
+
+	buf := make([]*uast.Node, 3, 10)
+	r, err := FilterInto(n, "//*", buf)
+	assert.Nil(t, err)
+	assert.Equal(t, all, r)
+	assert.True(t, &buf[0] == &r[0], "the buffer is reused")
+
+	small := make([]*uast.Node, 0, 1)
+	r, err = FilterInto(n, "//*", small)
+	assert.Nil(t, err)
+	assert.Equal(t, all, r)
+
+	r, err = FilterInto(n, "//child3", buf)
+	assert.Nil(t, err)
+	assert.Len(t, r, 0)
+
+	r, err = FilterInto(n, "//*", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, all, r)
+
+	_, err = FilterInto(n, "//*[", buf)
+	assert.IsType(t, &FilterError{}, err)
+}
+
+func TestFilterChan(t *testing.T) {
+	n := nodeTree()
+	all, err := Filter(n, "//*")
+	assert.Nil(t, err)
+
+	var r []*uast.Node
+	nodes, errc := FilterChan(n, "//*")
+	for node := range nodes {
+		// Running other queries while streaming must not block.
+		_, err := Filter(node, "//*")
+		assert.Nil(t, err)
+		r = append(r, node)
+	}
+	assert.Nil(t, <-errc)
+	assert.Equal(t, all, r)
+
+	nodes, errc = FilterChan(n, "//*[")
+	_, ok := <-nodes
+	assert.False(t, ok)
+	assert.IsType(t, &FilterError{}, <-errc)
+
+	nodes, errc = FilterChan(nil, "//*")
+	_, ok = <-nodes
+	assert.False(t, ok)
+	assert.Nil(t, <-errc)
+}
+
+func TestMarshalNodes(t *testing.T) {
+	n := nodeTree()
+	n.Children[1].Roles = []uast.Role{uast.Identifier, uast.Expression}
+	n.Children[1].Properties = map[string]string{"k": "v"}
+	n.Children[1].StartPosition = &uast.Position{Offset: 3, Line: 1, Col: 4}
+	n.Children[1].EndPosition = &uast.Position{Offset: 7, Line: 2, Col: 1}
+	n.Children[1].Children[0].Token = "a"
+
+	nodes, err := Filter(n, "//child1|//child2")
+	assert.Nil(t, err)
+
+	data, err := MarshalNodes(nodes)
+	assert.Nil(t, err)
+
+	r, err := UnmarshalNodes(data)
+	assert.Nil(t, err)
+	assert.Len(t, r, 2)
+	for i := range nodes {
+		assert.True(t, Equal(nodes[i], r[i]))
+	}
+	assert.Equal(t, []uast.Role{uast.Identifier, uast.Expression}, r[1].Roles)
+	assert.Equal(t, &uast.Position{Offset: 7, Line: 2, Col: 1}, r[1].EndPosition)
+
+	data, err = MarshalNodes(nil)
+	assert.Nil(t, err)
+	r, err = UnmarshalNodes(data)
+	assert.Nil(t, err)
+	assert.Len(t, r, 0)
+
+	_, err = MarshalNodes([]*uast.Node{n, nil})
+	assert.IsType(t, &ErrInvalidArgument{}, err)
+
+	_, err = UnmarshalNodes([]byte{0xff})
+	assert.NotNil(t, err)
+}
+
+func TestFilterFirst(t *testing.T) {
+	n, err := FilterFirst(nodeTree(), "//child2/*")
+	assert.Nil(t, err)
+	assert.Equal(t, "subchild21", n.InternalType)
+
+	n, err = FilterFirst(nodeTree(), "//child3")
+	assert.Nil(t, err)
+	assert.Nil(t, n)
+
+	_, err = FilterFirst(nodeTree(), "count(//*)")
+	assert.NotNil(t, err)
+}
+
+func TestFilterAll(t *testing.T) {
+	n := nodeTree()
+	queries := []string{"//*", "//child2/*", "", "//*[", "//child3", "count(//*)"}
+
+	results, err := FilterAll(n, queries)
+	assert.Len(t, results, len(queries))
+	for i, q := range queries {
+		expected, qerr := Filter(n, q)
+		if qerr != nil {
+			assert.Nil(t, results[i], q)
+			continue
+		}
+		assert.Equal(t, expected, results[i], q)
+	}
+
+	errs, ok := err.(QueriesError)
+	assert.True(t, ok)
+	assert.Len(t, errs, 2)
+	assert.Equal(t, &FilterError{Query: "//*[", Kind: SyntaxError, Msg: "Invalid expression"}, errs[3])
+	assert.IsType(t, &FilterError{}, errs[5])
+	assert.Equal(t, ResultTypeError, errs[5].(*FilterError).Kind)
+	assert.Equal(t, "query 3: "+errs[3].Error()+"\nquery 5: "+errs[5].Error(), err.Error())
+
+	results, err = FilterAll(n, queries[:2])
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+
+	results, err = FilterAll(nil, queries)
+	assert.Nil(t, err)
+	assert.Len(t, results, len(queries))
+}
+
+func TestFilterCount(t *testing.T) {
+	queries := []string{
+		"//*", "/*", "//child2/*", "//subchild21", "//child3", "//*[not(*)]", "//*[1]",
+	}
+
+	for _, q := range queries {
+		nodes, err := Filter(nodeTree(), q)
+		assert.Nil(t, err)
+
+		count, err := FilterCount(nodeTree(), q)
+		assert.Nil(t, err)
+		assert.Equal(t, len(nodes), count, q)
+	}
+
+	count, err := FilterCount(nodeTree(), "")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	_, err = FilterCount(nodeTree(), "count(//*)")
+	assert.NotNil(t, err)
+}
+
+func TestContextFilter(t *testing.T) {
+	ctx := NewContext()
+
+	r, err := ctx.Filter(nodeTree(), "//child2/subchild21")
+	assert.Nil(t, err)
+	assert.Len(t, r, 1)
+	assert.Equal(t, "subchild21", r[0].InternalType)
+
+	_, err = ctx.Filter(nodeTree(), "//*[")
+	assert.IsType(t, &FilterError{}, err)
+
+	b, err := ctx.FilterBool(nodeTree(), "boolean(//child1)")
+	assert.Nil(t, err)
+	assert.True(t, b)
+
+	n, err := ctx.FilterNumber(nodeTree(), "count(//*)")
+	assert.Nil(t, err)
+	assert.Equal(t, 5.0, n)
+
+	s, err := ctx.FilterString(nodeTree(), "name(/*)")
+	assert.Nil(t, err)
+	assert.Equal(t, "parent", s)
+}
+
+func TestFilterCtx(t *testing.T) {
+	r, err := FilterCtx(context.Background(), nodeTree(), "//child2/*")
+	assert.Nil(t, err)
+	assert.Len(t, r, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, err = FilterCtx(ctx, nodeTree(), "//child2/*")
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, r)
+
+	r, err = NewContext().FilterCtx(ctx, nodeTree(), "//child2/*")
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, r)
+}
+
+func TestContextFilterConcurrent(t *testing.T) {
+	const trees = 16
+
+	var wg sync.WaitGroup
+	for i := 0; i < trees; i++ {
+		root := &uast.Node{InternalType: "root"}
+		for j := 0; j <= i; j++ {
+			root.Children = append(root.Children, &uast.Node{
+				InternalType: "leaf",
+				Token:        fmt.Sprint(i),
+				Properties:   map[string]string{"b": "2", "a": "1"},
+			})
+		}
+
+		wg.Add(1)
+		go func(i int, root *uast.Node) {
+			defer wg.Done()
+			ctx := NewContext()
+			for k := 0; k < 20; k++ {
+				r, err := ctx.Filter(root, fmt.Sprintf("//leaf[@token='%d'][@a='1']", i))
+				assert.Nil(t, err)
+				assert.Len(t, r, i+1)
+				for _, n := range r {
+					assert.Equal(t, root.Children[0].Token, n.Token)
+				}
+
+				count, err := Filter(root, "//leaf")
+				assert.Nil(t, err)
+				assert.Len(t, count, i+1)
+			}
+		}(i, root)
+	}
+	wg.Wait()
+}
+
+func TestFilter_ConcurrentErrors(t *testing.T) {
+	calls := []struct {
+		msg  string
+		call func(ctx *Context) error
+	}{
+		{"Result of expression is not NODESET (is: NUMBER)", func(ctx *Context) error {
+			_, err := ctx.Filter(nodeTree(), "count(//*)")
+			return err
+		}},
+		{"Result of expression is not BOOLEAN (is: NODESET)", func(ctx *Context) error {
+			_, err := ctx.FilterBool(nodeTree(), "//*")
+			return err
+		}},
+		{"Result of expression is not NUMBER (is: STRING)", func(ctx *Context) error {
+			_, err := ctx.FilterNumber(nodeTree(), "string(//*)")
+			return err
+		}},
+		{"Invalid expression", func(ctx *Context) error {
+			_, err := ctx.FilterCount(nodeTree(), "//*[")
+			return err
+		}},
+		{"Invalid expression", func(*Context) error {
+			_, err := Prepare("//*[@token=")
+			return err
+		}},
+		{"Undefined variable", func(*Context) error {
+			_, err := FilterWithVars(nodeTree(), "//*[$missing]", nil)
+			return err
+		}},
+		{"Result of expression is not NODESET (is: STRING)", func(*Context) error {
+			_, err := FilterWithVars(nodeTree(), "string(//*)", nil)
+			return err
+		}},
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range calls {
+		wg.Add(1)
+		go func(msg string, call func(*Context) error) {
+			defer wg.Done()
+			ctx := NewContext()
+			for k := 0; k < 50; k++ {
+				err := call(ctx)
+				if assert.IsType(t, &FilterError{}, err) {
+					assert.Equal(t, msg, err.(*FilterError).Msg)
+				}
+			}
+		}(c.msg, c.call)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for k := 0; k < 50; k++ {
+			iter, err := NewIterator(nodeTree(), PostOrder)
+			assert.Nil(t, err)
+			count := 0
+			for range iter.Iterate() {
+				count++
+			}
+			assert.Equal(t, 5, count)
+			iter.Dispose()
+		}
+	}()
+	wg.Wait()
+}
+
 func TestFilter_All(t *testing.T) {
 	n := &uast.Node{}
 
@@ -196,6 +540,648 @@ func TestFilter_InvalidExpression(t *testing.T) {
 	n := &uast.Node{}
 
 	r, err := Filter(n, ":")
-	assert.Equal(t, &ErrInvalidArgument{Message: "Invalid expression"}, err)
+	assert.Equal(t, &FilterError{Query: ":", Kind: SyntaxError, Msg: "Invalid expression"}, err)
+	assert.Len(t, r, 0)
+
+	// the syntax errors were returned as *ErrInvalidArgument
+	var invalid *ErrInvalidArgument
+	if assert.True(t, errors.As(err, &invalid)) {
+		assert.Equal(t, "Invalid expression", invalid.Message)
+	}
+
+	_, err = FilterBool(n, "//*")
+	assert.False(t, errors.As(err, &invalid))
+}
+
+func TestFilter_NilChildren(t *testing.T) {
+	r, err := Filter(&uast.Node{Children: []*uast.Node{nil, {InternalType: "a"}}}, "//a")
+	assert.Nil(t, err)
+	assert.Len(t, r, 1)
+
+	n := nilChildrenTree()
+	r, err = Filter(n, "//*")
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n, n.Children[1], n.Children[3], n.Children[3].Children[1], n.Children[3].Children[3]}, r)
+
+	q, err := Prepare("//subchild22")
+	assert.Nil(t, err)
+	defer q.Close()
+	r, err = q.Filter(n)
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n.Children[3].Children[3]}, r)
+
+	for _, order := range []TreeOrder{PreOrder, PostOrder, LevelOrder, PositionOrder} {
+		iter, err := NewIterator(n, order)
+		assert.Nil(t, err)
+		nodes, err := iter.ToSlice()
+		assert.Nil(t, err)
+		assert.Len(t, nodes, 5, "order %d", order)
+		iter.Dispose()
+	}
+}
+
+func TestFilterMarshal(t *testing.T) {
+	n := &uast.Node{
+		InternalType: "root",
+		Children: []*uast.Node{{
+			InternalType:  "a",
+			Token:         "foo",
+			Roles:         []uast.Role{uast.Identifier},
+			Properties:    map[string]string{"k": "v"},
+			StartPosition: &uast.Position{Offset: 1, Line: 1, Col: 2},
+			EndPosition:   &uast.Position{Offset: 4, Line: 1, Col: 5},
+			Children:      []*uast.Node{{InternalType: "b"}},
+		}},
+	}
+
+	r, err := FilterMarshal(n, "//a")
+	assert.Nil(t, err)
+	assert.Len(t, r, 1)
+
+	out := &uast.Node{}
+	assert.Nil(t, out.Unmarshal(r[0]))
+	assert.Equal(t, n.Children[0], out)
+
+	r, err = FilterMarshal(n, ":")
+	assert.NotNil(t, err)
 	assert.Len(t, r, 0)
 }
+
+func TestFilterBounded(t *testing.T) {
+	inner := &uast.Node{InternalType: "stmt"}
+	nested := &uast.Node{
+		InternalType: "func",
+		Children:     []*uast.Node{inner},
+	}
+	outer := &uast.Node{InternalType: "stmt"}
+	n := &uast.Node{
+		InternalType: "func",
+		Children:     []*uast.Node{outer, nested},
+	}
+
+	r, err := FilterBounded(n, "//stmt", []string{"func"})
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{outer}, r)
+	assert.True(t, r[0] == outer)
+
+	r, err = FilterBounded(n, "//func", []string{"func"})
+	assert.Nil(t, err)
+	assert.Len(t, r, 2)
+	assert.True(t, r[1] == nested)
+
+	r, err = FilterBounded(n, "//stmt", nil)
+	assert.Nil(t, err)
+	assert.Len(t, r, 2)
+	assert.Len(t, nested.Children, 1)
+}
+
+func TestWarmup(t *testing.T) {
+	assert.Nil(t, Warmup())
+}
+
+func TestFilterByProperty(t *testing.T) {
+	a := &uast.Node{Properties: map[string]string{"k": "v"}}
+	b := &uast.Node{Properties: map[string]string{"k": "w"}}
+	c := &uast.Node{Properties: map[string]string{"k": ""}}
+	n := &uast.Node{Children: []*uast.Node{a, b, c}}
+
+	r, err := FilterByProperty(n, "k", "v")
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{a}, r)
+
+	r, err = FilterByProperty(n, "k", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{c}, r)
+
+	r, err = FilterByProperty(n, "x", "")
+	assert.Nil(t, err)
+	assert.Len(t, r, 0)
+}
+
+func TestFilterHasProperty(t *testing.T) {
+	a := &uast.Node{Properties: map[string]string{"k": "v"}}
+	b := &uast.Node{Properties: map[string]string{"j": "w"}}
+	c := &uast.Node{Properties: map[string]string{"k": ""}}
+	n := &uast.Node{Children: []*uast.Node{a, b, c}}
+
+	r, err := FilterHasProperty(n, "k")
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{a, c}, r)
+
+	r, err = FilterHasProperty(nil, "k")
+	assert.Nil(t, err)
+	assert.Len(t, r, 0)
+}
+
+func TestFindByRole(t *testing.T) {
+	root := benchmarkTree()
+	for _, role := range []uast.Role{uast.Function, uast.Identifier} {
+		expected, err := Filter(root, "//*[@role"+RoleName(role)+"]")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, FindByRole(root, role), role.String())
+	}
+	assert.Len(t, FindByRole(root, uast.Identifier), 1000)
+	assert.Len(t, FindByRole(root, uast.Expression), 0)
+
+	expected, err := Filter(root, "//*[@roleFunction][@roleDeclaration]")
+	assert.Nil(t, err)
+	assert.Len(t, expected, 100)
+	assert.Equal(t, expected, FindByRoles(root, uast.Declaration, uast.Function))
+	assert.Len(t, FindByRoles(root, uast.Identifier, uast.Function), 0)
+	assert.Len(t, FindByRoles(root), 1101)
+	assert.Len(t, FindByRole(nil, uast.Identifier), 0)
+}
+
+func TestFindByInternalType(t *testing.T) {
+	root := benchmarkTree()
+	for _, typ := range []string{"File", "FunctionDef", "Name", "Call"} {
+		expected, err := Filter(root, "//"+typ)
+		assert.Nil(t, err)
+		assert.Len(t, FindByInternalType(root, typ), len(expected), typ)
+		if len(expected) > 0 {
+			assert.Equal(t, expected, FindByInternalType(root, typ), typ)
+		}
+	}
+	assert.Len(t, FindByInternalType(root, "Name"), 1000)
+	assert.Len(t, FindByInternalType(nil, "Name"), 0)
+}
+
+func TestFindByToken(t *testing.T) {
+	root := benchmarkTree()
+
+	expected, err := Filter(root, "//*[@token='name1']")
+	assert.Nil(t, err)
+	assert.Len(t, expected, 100)
+	assert.Equal(t, expected, FindByToken(root, "name1"))
+	assert.Len(t, FindByToken(root, "name"), 0)
+
+	assert.Len(t, FindByTokenFunc(root, func(token string) bool {
+		return strings.HasPrefix(token, "name")
+	}), 1000)
+	assert.Len(t, FindByTokenFunc(root, regexp.MustCompile(`^name[1-3]$`).MatchString), 300)
+	assert.Len(t, FindByTokenFunc(root, func(token string) bool {
+		return strings.EqualFold(token, "NAME9")
+	}), 100)
+
+	// the nodes without a token have an empty one
+	assert.Len(t, FindByToken(root, ""), 101)
+	assert.Len(t, FindByToken(nil, "name1"), 0)
+}
+
+func TestMapNodes(t *testing.T) {
+	n := nodeTree()
+	parent := func(node *uast.Node) *uast.Node {
+		if node == n.Children[1].Children[0] || node == n.Children[1].Children[1] {
+			return n.Children[1]
+		}
+		return nil
+	}
+
+	r := MapNodes(FindByRoles(n), parent)
+	assert.Equal(t, []*uast.Node{nil, nil, nil, n.Children[1], n.Children[1]}, r)
+	assert.Nil(t, MapNodes(nil, parent))
+}
+
+func TestFilterNodes(t *testing.T) {
+	n := nodeTree()
+	nodes := FindByRoles(n)
+	r := FilterNodes(nodes, func(node *uast.Node) bool {
+		return len(node.Children) == 0
+	})
+	assert.Equal(t, []*uast.Node{n.Children[0], n.Children[1].Children[0], n.Children[1].Children[1]}, r)
+	assert.Len(t, nodes, 5)
+
+	assert.Len(t, FilterNodes(nodes, func(*uast.Node) bool { return false }), 0)
+}
+
+func TestMapTokens(t *testing.T) {
+	n := nodeTree()
+	n.Children[0].Token = "a"
+	n.Children[1].Children[1].Token = "b"
+
+	assert.Equal(t, []string{"", "a", "", "", "b"}, MapTokens(FindByRoles(n)))
+	assert.Equal(t, []string{"a", ""}, MapTokens([]*uast.Node{n.Children[0], nil}))
+	assert.Nil(t, MapTokens(nil))
+}
+
+func TestChildrenByRole(t *testing.T) {
+	arg := func(token string) *uast.Node {
+		return &uast.Node{Token: token, Roles: []uast.Role{uast.Argument}}
+	}
+
+	a, b := arg("a"), arg("b")
+	name := &uast.Node{Roles: []uast.Role{uast.Identifier}, Children: []*uast.Node{arg("nested")}}
+	fn := &uast.Node{Children: []*uast.Node{name, a, nil, b}}
+
+	assert.Equal(t, []*uast.Node{a, b}, ChildrenByRole(fn, uast.Argument))
+	assert.Equal(t, []*uast.Node{name}, ChildrenByRole(fn, uast.Identifier))
+	assert.Len(t, ChildrenByRole(fn, uast.Function), 0)
+	assert.Len(t, ChildrenByRole(nil, uast.Argument), 0)
+
+	assert.Equal(t, a, FirstChildByRole(fn, uast.Argument))
+	assert.Equal(t, name, FirstChildByRole(fn, uast.Identifier))
+	assert.Nil(t, FirstChildByRole(fn, uast.Function))
+	assert.Nil(t, FirstChildByRole(a, uast.Argument))
+	assert.Nil(t, FirstChildByRole(nil, uast.Argument))
+}
+
+func BenchmarkFindByRole(b *testing.B) {
+	root := benchmarkTree()
+	b.Run("xpath", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := Filter(root, "//*[@roleIdentifier]"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("go", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			FindByRole(root, uast.Identifier)
+		}
+	})
+}
+
+func TestFilterOrError(t *testing.T) {
+	n := &uast.Node{InternalType: "a"}
+
+	r, fallback, err := FilterOrError(n, "//a", "//b")
+	assert.Nil(t, err)
+	assert.False(t, fallback)
+	assert.Len(t, r, 1)
+
+	r, fallback, err = FilterOrError(n, ":", "//*")
+	assert.Nil(t, err)
+	assert.True(t, fallback)
+	assert.Len(t, r, 1)
+
+	r, fallback, err = FilterOrError(n, "count(//*)", "//*")
+	assert.NotNil(t, err)
+	assert.False(t, fallback)
+	assert.Len(t, r, 0)
+
+	_, fallback, err = FilterOrError(n, ":", ":")
+	assert.NotNil(t, err)
+	assert.True(t, fallback)
+}
+
+func TestFilterRanked(t *testing.T) {
+	n := nodeTree()
+	score := func(n *uast.Node) float64 {
+		return float64(len(n.Children))
+	}
+
+	r, err := FilterRanked(n, "//*", score)
+	assert.Nil(t, err)
+	assert.Len(t, r, 5)
+
+	var types []string
+	for _, rn := range r {
+		types = append(types, rn.Node.InternalType)
+	}
+	assert.Equal(t, []string{"parent", "child2", "child1", "subchild21", "subchild22"}, types)
+	assert.Equal(t, 2.0, r[0].Score)
+
+	_, err = FilterRanked(n, ":", score)
+	assert.NotNil(t, err)
+}
+
+func TestFilterDetached(t *testing.T) {
+	n := nodeTree()
+	n.Children[1].Properties = map[string]string{"k": "v"}
+
+	r, err := FilterDetached(n, "//child2")
+	assert.Nil(t, err)
+	assert.Len(t, r, 1)
+	assert.Equal(t, n.Children[1], r[0])
+	assert.False(t, n.Children[1] == r[0])
+
+	r[0].Properties["k"] = "w"
+	r[0].Children[0].InternalType = "changed"
+	assert.Equal(t, "v", n.Children[1].Properties["k"])
+	assert.Equal(t, "subchild21", n.Children[1].Children[0].InternalType)
+}
+
+func TestFilterSubtrees(t *testing.T) {
+	n := nodeTree()
+
+	r, err := FilterSubtrees(n, "//child2")
+	assert.Nil(t, err)
+	assert.Len(t, r, 1)
+	assert.Equal(t, n.Children[1], r[0])
+	assert.False(t, n.Children[1] == r[0])
+	assert.False(t, n.Children[1].Children[0] == r[0].Children[0])
+
+	_, err = FilterSubtrees(n, ":")
+	assert.NotNil(t, err)
+}
+
+func TestFilterBytes(t *testing.T) {
+	data, err := nodeTree().Marshal()
+	assert.Nil(t, err)
+
+	r, err := FilterBytes(data, "//subchild22")
+	assert.Nil(t, err)
+	assert.Len(t, r, 1)
+
+	_, err = FilterBytes([]byte{0xff}, "//*")
+	assert.NotNil(t, err)
+}
+
+func TestFilterPairs(t *testing.T) {
+	n := nodeTree()
+	child1, child2 := n.Children[0], n.Children[1]
+	sub21, sub22 := child2.Children[0], child2.Children[1]
+
+	r, err := FilterPairs(n, "//child1|//child2", "//subchild21|//subchild22", CartesianJoin, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, [][2]*uast.Node{
+		{child1, sub21}, {child1, sub22}, {child2, sub21}, {child2, sub22},
+	}, r)
+
+	r, err = FilterPairs(n, "//*", "//subchild22", ContainmentJoin, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, [][2]*uast.Node{{n, sub22}, {child2, sub22}}, r)
+
+	r, err = FilterPairs(n, "//*", "//*", AdjacentJoin, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, [][2]*uast.Node{{child1, child2}, {sub21, sub22}}, r)
+
+	_, err = FilterPairs(n, "//*", "//*", CartesianJoin, 24)
+	assert.IsType(t, &ErrInvalidArgument{}, err)
+
+	_, err = FilterPairs(n, "//*", ":", CartesianJoin, 0)
+	assert.NotNil(t, err)
+}
+
+func TestFilterBoundingSpan(t *testing.T) {
+	n := &uast.Node{
+		InternalType: "root",
+		Children: []*uast.Node{{
+			InternalType:  "a",
+			StartPosition: &uast.Position{Offset: 10},
+			EndPosition:   &uast.Position{Offset: 15},
+		}, {
+			InternalType:  "a",
+			StartPosition: &uast.Position{Offset: 4},
+			EndPosition:   &uast.Position{Offset: 8},
+		}, {
+			InternalType:  "a",
+			StartPosition: &uast.Position{Offset: 0},
+		}},
+	}
+
+	start, end, ok := FilterBoundingSpan(n, "//a")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(4), start)
+	assert.Equal(t, uint32(15), end)
+
+	_, _, ok = FilterBoundingSpan(n, "//root")
+	assert.False(t, ok)
+
+	_, _, ok = FilterBoundingSpan(n, ":")
+	assert.False(t, ok)
+}
+
+func TestFilterText(t *testing.T) {
+	source := []byte("foo = bar")
+	n := &uast.Node{
+		InternalType: "assign",
+		Children: []*uast.Node{{
+			InternalType:  "id",
+			StartPosition: &uast.Position{Offset: 0},
+			EndPosition:   &uast.Position{Offset: 3},
+		}, {
+			InternalType: "id",
+		}, {
+			InternalType:  "id",
+			StartPosition: &uast.Position{Offset: 6},
+			EndPosition:   &uast.Position{Offset: 9},
+		}, {
+			InternalType:  "id",
+			StartPosition: &uast.Position{Offset: 6},
+			EndPosition:   &uast.Position{Offset: 20},
+		}},
+	}
+
+	r, err := FilterText(n, "//id", source)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo", "bar"}, r)
+
+	_, err = FilterText(n, ":", source)
+	assert.NotNil(t, err)
+}
+
+func TestLanguage(t *testing.T) {
+	assert.Equal(t, "python", Language(&uast.Node{InternalType: "Module"}))
+	assert.Equal(t, "java", Language(&uast.Node{InternalType: "CompilationUnit"}))
+
+	wrapped := &uast.Node{
+		InternalType: "File",
+		Children:     []*uast.Node{{InternalType: "Program"}},
+	}
+	assert.Equal(t, "javascript", Language(wrapped))
+
+	assert.Equal(t, "", Language(nodeTree()))
+	assert.Equal(t, "", Language(nil))
+}
+
+func TestFilterByLanguage(t *testing.T) {
+	n := nodeTree()
+	n.InternalType = "Module"
+	queries := map[string]string{
+		"python": "//child1",
+		"java":   "//child2",
+	}
+
+	r, err := FilterByLanguage(n, queries)
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n.Children[0]}, r)
+
+	n.InternalType = "CompilationUnit"
+	r, err = FilterByLanguage(n, queries)
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n.Children[1]}, r)
+
+	n.InternalType = "unknown"
+	_, err = FilterByLanguage(n, queries)
+	assert.IsType(t, &ErrInvalidArgument{}, err)
+
+	queries[DefaultQuery] = "//subchild21"
+	r, err = FilterByLanguage(n, queries)
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n.Children[1].Children[0]}, r)
+}
+
+func TestPartition(t *testing.T) {
+	n := nodeTree()
+	child1, child2 := n.Children[0], n.Children[1]
+	sub21, sub22 := child2.Children[0], child2.Children[1]
+
+	matched, unmatched, err := Partition(n, "//child1|//subchild22")
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{child1, sub22}, matched)
+	assert.Equal(t, []*uast.Node{child2, sub21}, unmatched)
+
+	matched, unmatched, err = Partition(n, "//parent")
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n}, matched)
+	assert.Len(t, unmatched, 0)
+
+	_, _, err = Partition(n, ":")
+	assert.NotNil(t, err)
+}
+
+func TestFilter_ErrorKind(t *testing.T) {
+	cases := map[string]ErrorKind{
+		"//*[":       SyntaxError,
+		"'abc":       SyntaxError,
+		"foo()":      SyntaxError,
+		"$x":         SyntaxError,
+		"count()":    SyntaxError,
+		"//a:b":      SyntaxError,
+		"boolean(1)": ResultTypeError,
+		"count(//*)": ResultTypeError,
+	}
+
+	for query, kind := range cases {
+		_, err := Filter(nodeTree(), query)
+		ferr, ok := err.(*FilterError)
+		if assert.True(t, ok, query) {
+			assert.Equal(t, kind, ferr.Kind, query)
+			assert.Equal(t, query, ferr.Query)
+		}
+	}
+
+	_, err := FilterBool(nodeTree(), "//*")
+	assert.Equal(t, &FilterError{
+		Query: "//*",
+		Kind:  ResultTypeError,
+		Msg:   "Result of expression is not BOOLEAN (is: NODESET)",
+	}, err)
+	assert.Equal(t, `result type error in query "//*": Result of expression is not BOOLEAN (is: NODESET)`, err.Error())
+
+	// the failures of the iterators have no query
+	err = &FilterError{Kind: RuntimeError, Msg: "Unable to get memory"}
+	assert.Equal(t, "runtime error: Unable to get memory", err.Error())
+}
+
+func TestFilter_InvalidExpressionRepeated(t *testing.T) {
+	n := nodeTree()
+
+	for i := 0; i < 1000; i++ {
+		_, err := Filter(n, ":")
+		assert.Equal(t, &FilterError{Query: ":", Kind: SyntaxError, Msg: "Invalid expression"}, err)
+
+		r, err := Filter(n, "//*")
+		assert.Nil(t, err)
+		assert.Len(t, r, 5)
+	}
+}
+
+func TestEvalBool(t *testing.T) {
+	n := nodeTree()
+
+	r, err := EvalBool(n, "count(//*) > 3")
+	assert.Nil(t, err)
+	assert.True(t, r)
+
+	r, err = EvalBool(n, "//child1")
+	assert.Nil(t, err)
+	assert.True(t, r)
+
+	r, err = EvalBool(n, "//unknown")
+	assert.Nil(t, err)
+	assert.False(t, r)
+
+	r, err = EvalBool(n, "name(/*)")
+	assert.Nil(t, err)
+	assert.True(t, r)
+
+	_, err = EvalBool(n, ":")
+	assert.NotNil(t, err)
+}
+
+func TestEvalNumber(t *testing.T) {
+	n := nodeTree()
+
+	r, err := EvalNumber(n, "count(//*)")
+	assert.Nil(t, err)
+	assert.Equal(t, 5.0, r)
+
+	r, err = EvalNumber(n, "count(//*) div 2")
+	assert.Nil(t, err)
+	assert.Equal(t, 2.5, r)
+
+	_, err = EvalNumber(n, "number('foo')")
+	assert.EqualError(t, err, "EvalNumber() failed: expression result is NaN")
+
+	_, err = EvalNumber(n, "//*")
+	assert.NotNil(t, err)
+}
+
+func TestEvalString(t *testing.T) {
+	n := nodeTree()
+	n.Children[1].Children[0].Token = "foo"
+
+	r, err := EvalString(n, "name(/*)")
+	assert.Nil(t, err)
+	assert.Equal(t, "parent", r)
+
+	r, err = EvalString(n, "//subchild21/@token")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", r)
+
+	r, err = EvalString(n, "count(//*)")
+	assert.Nil(t, err)
+	assert.Equal(t, "5", r)
+
+	_, err = EvalString(n, ":")
+	assert.NotNil(t, err)
+}
+
+func TestEval(t *testing.T) {
+	n := nodeTree()
+
+	r, err := Eval(n, "//child1")
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n.Children[0]}, r)
+
+	r, err = Eval(n, "count(//*) > 3")
+	assert.Nil(t, err)
+	assert.Equal(t, true, r)
+
+	r, err = Eval(n, "count(//*)")
+	assert.Nil(t, err)
+	assert.Equal(t, 5.0, r)
+
+	r, err = Eval(n, "name(/*)")
+	assert.Nil(t, err)
+	assert.Equal(t, "parent", r)
+
+	_, err = Eval(n, ":")
+	assert.IsType(t, &FilterError{}, err)
+}
+
+// BenchmarkFilter_Properties filters trees of 100 nodes with a growing number
+// of properties each. The sorted keys of a node are computed once per query and
+// not once per property, so the time grows linearly with the properties.
+func BenchmarkFilter_Properties(b *testing.B) {
+	for _, props := range []int{1, 10, 100} {
+		root := &uast.Node{InternalType: "root"}
+		for i := 0; i < 100; i++ {
+			child := &uast.Node{InternalType: "child", Properties: make(map[string]string, props)}
+			for p := 0; p < props; p++ {
+				child.Properties[fmt.Sprintf("key%d", p)] = fmt.Sprintf("value%d", p)
+			}
+			root.Children = append(root.Children, child)
+		}
+
+		b.Run(fmt.Sprintf("props=%d", props), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := Filter(root, "//*[@key0='value0']"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
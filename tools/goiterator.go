@@ -0,0 +1,129 @@
+package tools
+
+import (
+	"fmt"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// GoIterator traverses a UAST tree like Iterator, giving the same sequence of
+// nodes, but it is implemented in Go over the Children of the nodes: it takes
+// no lock, so any number of them can run concurrently, and it holds no native
+// resources, so it needs no Dispose. A single GoIterator must not be used by
+// several goroutines at the same time.
+type GoIterator struct {
+	order TreeOrder
+
+	// stack holds the pending nodes of PreOrder and PostOrder, the latter with
+	// the index of their next child to visit, and queue the ones of LevelOrder.
+	stack []goIterEntry
+	queue []*uast.Node
+
+	// reversed holds the nodes of a ReverseLevelOrder not returned yet, which
+	// are returned from the end.
+	reversed []*uast.Node
+}
+
+type goIterEntry struct {
+	node *uast.Node
+	next int
+}
+
+// NewGoIterator returns a GoIterator over the tree rooted at node with the
+// given traversal order, which can be PreOrder, PostOrder, LevelOrder or
+// ReverseLevelOrder. The position orders are not supported since libuast
+// sorts the nodes with the same position in an unspecified order, so an
+// *ErrInvalidArgument error is returned for them. The nil children are
+// skipped.
+func NewGoIterator(node *uast.Node, order TreeOrder) (*GoIterator, error) {
+	i := &GoIterator{order: order}
+	switch order {
+	case PreOrder, PostOrder:
+		if node != nil {
+			i.stack = []goIterEntry{{node, 0}}
+		}
+	case LevelOrder:
+		if node != nil {
+			i.queue = []*uast.Node{node}
+		}
+	case ReverseLevelOrder:
+		level := &GoIterator{order: LevelOrder}
+		if node != nil {
+			level.queue = []*uast.Node{node}
+		}
+		for n := level.Next(); n != nil; n = level.Next() {
+			i.reversed = append(i.reversed, n)
+		}
+	default:
+		return nil, &ErrInvalidArgument{Message: fmt.Sprintf("unsupported tree order %d", order)}
+	}
+	return i, nil
+}
+
+// Next returns the next node of the traversal, or nil once it has finished.
+func (i *GoIterator) Next() *uast.Node {
+	switch i.order {
+	case PreOrder:
+		return i.nextPreOrder()
+	case PostOrder:
+		return i.nextPostOrder()
+	case LevelOrder:
+		return i.nextLevelOrder()
+	default:
+		if len(i.reversed) == 0 {
+			return nil
+		}
+		n := i.reversed[len(i.reversed)-1]
+		i.reversed = i.reversed[:len(i.reversed)-1]
+		return n
+	}
+}
+
+func (i *GoIterator) nextPreOrder() *uast.Node {
+	if len(i.stack) == 0 {
+		return nil
+	}
+
+	n := i.stack[len(i.stack)-1].node
+	i.stack = i.stack[:len(i.stack)-1]
+	for c := len(n.Children) - 1; c >= 0; c-- {
+		if n.Children[c] != nil {
+			i.stack = append(i.stack, goIterEntry{n.Children[c], 0})
+		}
+	}
+	return n
+}
+
+func (i *GoIterator) nextPostOrder() *uast.Node {
+	for len(i.stack) > 0 {
+		e := &i.stack[len(i.stack)-1]
+		if e.next < len(e.node.Children) {
+			child := e.node.Children[e.next]
+			e.next++
+			if child != nil {
+				i.stack = append(i.stack, goIterEntry{child, 0})
+			}
+			continue
+		}
+
+		i.stack = i.stack[:len(i.stack)-1]
+		return e.node
+	}
+	return nil
+}
+
+func (i *GoIterator) nextLevelOrder() *uast.Node {
+	if len(i.queue) == 0 {
+		return nil
+	}
+
+	n := i.queue[0]
+	i.queue[0] = nil
+	i.queue = i.queue[1:]
+	for _, child := range n.Children {
+		if child != nil {
+			i.queue = append(i.queue, child)
+		}
+	}
+	return n
+}
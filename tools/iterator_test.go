@@ -1,7 +1,12 @@
 package tools
 
 import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/bblfsh/sdk.v1/uast"
@@ -87,6 +92,626 @@ func TestIter_Disposed(t *testing.T) {
 	}
 }
 
+func TestIter_ForEachCtx(t *testing.T) {
+	iter, err := NewIterator(nodeTree(), PreOrder)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var types []string
+	err = iter.ForEachCtx(ctx, func(n *uast.Node) error {
+		types = append(types, n.InternalType)
+		if len(types) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []string{"parent", "child1"}, types)
+
+	err = iter.ForEachCtx(context.Background(), func(n *uast.Node) error {
+		types = append(types, n.InternalType)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"parent", "child1", "child2", "subchild21", "subchild22"}, types)
+}
+
+func TestIter_NextCtx(t *testing.T) {
+	iter, err := NewIterator(nodeTree(), PreOrder)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n, err := iter.NextCtx(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "parent", n.InternalType)
+
+	cancel()
+	_, err = iter.NextCtx(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	// the canceled step did not consume any node
+	testIterNode(t, iter, "child1")
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	var types []string
+	for {
+		n, err := iter.NextCtx(ctx)
+		assert.Nil(t, err)
+		if n == nil {
+			break
+		}
+		types = append(types, n.InternalType)
+	}
+	assert.Equal(t, []string{"child2", "subchild21", "subchild22"}, types)
+}
+
+func TestIter_Reset(t *testing.T) {
+	for _, order := range []TreeOrder{PreOrder, PostOrder, LevelOrder, PositionOrder} {
+		iter, err := NewIterator(nodeTree(), order)
+		assert.Nil(t, err)
+
+		var first, second []*uast.Node
+		for n := range iter.Iterate() {
+			first = append(first, n)
+		}
+
+		assert.Nil(t, iter.Reset())
+		for n := range iter.Iterate() {
+			second = append(second, n)
+		}
+		assert.Len(t, first, 5)
+		assert.Equal(t, first, second)
+
+		iter.Dispose()
+		assert.NotNil(t, iter.Reset())
+	}
+}
+
+func TestIter_Reinit(t *testing.T) {
+	iter, err := NewIterator(nodeTree(), PreOrder)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+
+	testIterNode(t, iter, "parent")
+	_, err = iter.Peek()
+	assert.Nil(t, err)
+
+	other := &uast.Node{InternalType: "other", Children: []*uast.Node{{InternalType: "a"}, {InternalType: "b"}}}
+	assert.Nil(t, iter.Reinit(other, PostOrder))
+	assert.Equal(t, -1, iter.Depth())
+	nodes, err := iter.ToSlice()
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{other.Children[0], other.Children[1], other}, nodes)
+
+	assert.Nil(t, iter.Reinit(nodeTree(), LevelOrder))
+	testIterNode(t, iter, "parent")
+	testIterNode(t, iter, "child1")
+
+	iter.Dispose()
+	assert.NotNil(t, iter.Reinit(other, PreOrder))
+}
+
+func BenchmarkIterator_New(b *testing.B) {
+	root := benchmarkTree().Children[0]
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		iter, err := NewIterator(root, PreOrder)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for n, _ := iter.Next(); n != nil; n, _ = iter.Next() {
+		}
+		iter.Dispose()
+	}
+}
+
+func BenchmarkIterator_Reinit(b *testing.B) {
+	root := benchmarkTree().Children[0]
+	iter, err := NewIterator(root, PreOrder)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer iter.Dispose()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := iter.Reinit(root, PreOrder); err != nil {
+			b.Fatal(err)
+		}
+		for n, _ := iter.Next(); n != nil; n, _ = iter.Next() {
+		}
+	}
+}
+
+func TestIter_Forest(t *testing.T) {
+	orders := []TreeOrder{
+		PreOrder, PostOrder, LevelOrder, PositionOrder, ReverseLevelOrder, ReversePositionOrder,
+	}
+	for _, order := range orders {
+		roots := []*uast.Node{nodeTree().Children[1], nil, nodeTree().Children[0], nodeTree()}
+
+		var expected []*uast.Node
+		var depths []int
+		for _, root := range roots {
+			if root == nil {
+				continue
+			}
+			iter, err := NewIterator(root, order)
+			assert.Nil(t, err)
+			for nd := range iter.IterateWithDepth() {
+				expected = append(expected, nd.Node)
+				depths = append(depths, nd.Depth)
+			}
+			iter.Dispose()
+		}
+		assert.Len(t, expected, 9)
+
+		iter, err := NewIteratorForest(roots, order)
+		assert.Nil(t, err)
+
+		for round := 0; round < 2; round++ {
+			var nodes []*uast.Node
+			for {
+				n, err := iter.Next()
+				assert.Nil(t, err)
+				if n == nil {
+					break
+				}
+				assert.Equal(t, depths[len(nodes)], iter.Depth(), "order %d", order)
+				nodes = append(nodes, n)
+			}
+			assert.Equal(t, expected, nodes, "order %d", order)
+			assert.Nil(t, iter.Reset())
+		}
+		iter.Dispose()
+	}
+
+	iter, err := NewIteratorForest(nil, PreOrder)
+	assert.Nil(t, err)
+	n, err := iter.Next()
+	assert.Nil(t, err)
+	assert.Nil(t, n)
+	_, err = iter.Next()
+	assert.NotNil(t, err)
+	iter.Dispose()
+}
+
+func TestIter_ToSlice(t *testing.T) {
+	iter, err := NewIterator(nodeTree(), LevelOrder)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+
+	testIterNode(t, iter, "parent")
+	nodes, err := iter.ToSlice()
+	assert.Nil(t, err)
+
+	var types []string
+	for _, n := range nodes {
+		types = append(types, n.InternalType)
+	}
+	assert.Equal(t, []string{"child1", "child2", "subchild21", "subchild22"}, types)
+
+	_, err = iter.ToSlice()
+	assert.NotNil(t, err)
+
+	assert.Nil(t, iter.Reset())
+	nodes, err = iter.ToSlice()
+	assert.Nil(t, err)
+	assert.Len(t, nodes, 5)
+
+	iter.Dispose()
+	_, err = iter.ToSlice()
+	assert.NotNil(t, err)
+}
+
+func TestIter_Peek(t *testing.T) {
+	iter, err := NewIterator(nodeTree(), PreOrder)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+
+	peek := func(expected string) {
+		n, err := iter.Peek()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, n.InternalType)
+	}
+
+	peek("parent")
+	peek("parent")
+	testIterNode(t, iter, "parent")
+	assert.Equal(t, 0, iter.Depth())
+
+	peek("child1")
+	assert.Equal(t, 0, iter.Depth())
+	testIterNode(t, iter, "child1")
+	testIterNode(t, iter, "child2")
+	peek("subchild21")
+	testIterNode(t, iter, "subchild21")
+	testIterNode(t, iter, "subchild22")
+
+	n, err := iter.Peek()
+	assert.Nil(t, err)
+	assert.Nil(t, n)
+	n, err = iter.Next()
+	assert.Nil(t, err)
+	assert.Nil(t, n)
+
+	_, err = iter.Peek()
+	assert.NotNil(t, err)
+
+	assert.Nil(t, iter.Reset())
+	peek("parent")
+	iter.Dispose()
+	_, err = iter.Peek()
+	assert.NotNil(t, err)
+	_, err = iter.Next()
+	assert.NotNil(t, err)
+}
+
+func TestIter_PeekForest(t *testing.T) {
+	first, second := nodeTree(), &uast.Node{InternalType: "second"}
+	iter, err := NewIteratorForest([]*uast.Node{first, second}, PostOrder)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+
+	for i := 0; i < 4; i++ {
+		_, err := iter.Next()
+		assert.Nil(t, err)
+	}
+	testIterNode(t, iter, "parent")
+
+	peek, err := iter.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, second, peek)
+	assert.Equal(t, 0, iter.Depth())
+
+	testIterNode(t, iter, "second")
+	assert.Equal(t, 0, iter.Depth())
+}
+
+func TestIter_Finalizer(t *testing.T) {
+	live := atomic.LoadInt64(&liveIterators)
+	func() {
+		iter, err := NewIterator(nodeTree(), PreOrder)
+		assert.Nil(t, err)
+		testIterNode(t, iter, "parent")
+	}()
+
+	// other iterators leaked by previous tests may be finalized too
+	for i := 0; i < 100 && atomic.LoadInt64(&liveIterators) > live; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, atomic.LoadInt64(&liveIterators) <= live, "the iterator was not finalized")
+}
+
+func TestIter_TooManyIterators(t *testing.T) {
+	var iters []*Iterator
+	defer func() {
+		for _, iter := range iters {
+			iter.Dispose()
+		}
+	}()
+
+	var err error
+	for len(iters) <= maxSlots {
+		var iter *Iterator
+		if iter, err = NewIterator(nodeTree(), PreOrder); err != nil {
+			break
+		}
+		iters = append(iters, iter)
+	}
+	assert.IsType(t, &errInternal{}, err)
+	assert.Contains(t, err.Error(), "too many concurrent queries and iterators")
+	assert.True(t, len(iters) <= maxSlots)
+
+	_, err = Filter(nodeTree(), "//*")
+	assert.IsType(t, &errInternal{}, err)
+
+	iters[0].Dispose()
+	r, err := Filter(nodeTree(), "//*")
+	assert.Nil(t, err)
+	assert.Len(t, r, 5)
+}
+
+func TestCloseUast(t *testing.T) {
+	iter, err := NewIterator(nodeTree(), PreOrder)
+	assert.Nil(t, err)
+	assert.NotNil(t, CloseUast())
+
+	testIterNode(t, iter, "parent")
+	iter.Dispose()
+	iter.Dispose()
+
+	assert.Nil(t, CloseUast())
+	assert.Nil(t, CloseUast())
+
+	// the state is created again when needed
+	r, err := Filter(nodeTree(), "//child2/*")
+	assert.Nil(t, err)
+	assert.Len(t, r, 2)
+
+	assert.Nil(t, CloseUast())
+	_, err = Filter(nodeTree(), "//*[")
+	assert.Equal(t, &FilterError{Query: "//*[", Kind: SyntaxError, Msg: "Invalid expression"}, err)
+
+	assert.Nil(t, CloseUast())
+	assert.Nil(t, ValidateXPath("//*"))
+	assert.Equal(t, 2, DescendantCount(nodeTree().Children[1]))
+
+	iter, err = NewIterator(nodeTree(), PostOrder)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+	testIterNode(t, iter, "child1")
+}
+
+func TestGoIterator(t *testing.T) {
+	trees := []*uast.Node{nodeTree(), nilChildrenTree(), benchmarkTree(), deepTree(100), {InternalType: "leaf"}}
+	orders := []TreeOrder{PreOrder, PostOrder, LevelOrder, ReverseLevelOrder}
+	for _, root := range trees {
+		for _, order := range orders {
+			iter, err := NewIterator(root, order)
+			assert.Nil(t, err)
+			expected, err := iter.ToSlice()
+			assert.Nil(t, err)
+			iter.Dispose()
+
+			giter, err := NewGoIterator(root, order)
+			assert.Nil(t, err)
+			var nodes []*uast.Node
+			for n := giter.Next(); n != nil; n = giter.Next() {
+				nodes = append(nodes, n)
+			}
+			assert.Equal(t, expected, nodes, "order %d", order)
+			assert.Nil(t, giter.Next())
+		}
+	}
+
+	for _, order := range []TreeOrder{PositionOrder, ReversePositionOrder, TreeOrder(100)} {
+		_, err := NewGoIterator(nodeTree(), order)
+		assert.IsType(t, &ErrInvalidArgument{}, err)
+	}
+
+	giter, err := NewGoIterator(nil, LevelOrder)
+	assert.Nil(t, err)
+	assert.Nil(t, giter.Next())
+}
+
+func TestGoIterator_Concurrent(t *testing.T) {
+	root := benchmarkTree()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			giter, err := NewGoIterator(root, PostOrder)
+			assert.Nil(t, err)
+			count := 0
+			for n := giter.Next(); n != nil; n = giter.Next() {
+				count++
+			}
+			assert.Equal(t, 1101, count)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestIter_Concurrent(t *testing.T) {
+	trees := []*uast.Node{benchmarkTree(), benchmarkTree(), nodeTree(), deepTree(500)}
+	orders := []TreeOrder{PreOrder, PostOrder, LevelOrder, ReverseLevelOrder}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		root, order := trees[g%len(trees)], orders[g%len(orders)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			giter, err := NewGoIterator(root, order)
+			assert.Nil(t, err)
+
+			for round := 0; round < 5; round++ {
+				iter, err := NewIterator(root, order)
+				assert.Nil(t, err)
+				for {
+					n, err := iter.Next()
+					assert.Nil(t, err)
+					expected := giter.Next()
+					if !assert.True(t, n == expected) || n == nil {
+						break
+					}
+				}
+				iter.Dispose()
+				giter, _ = NewGoIterator(root, order)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestIter_Depth(t *testing.T) {
+	depths := map[string]int{
+		"parent": 0, "child1": 1, "child2": 1, "subchild21": 2, "subchild22": 2,
+	}
+
+	orders := []TreeOrder{PreOrder, PostOrder, LevelOrder, PositionOrder, ReverseLevelOrder}
+	for _, order := range orders {
+		iter, err := NewIterator(nodeTree(), order)
+		assert.Nil(t, err)
+		assert.Equal(t, -1, iter.Depth())
+
+		count := 0
+		for {
+			n, err := iter.Next()
+			assert.Nil(t, err)
+			if n == nil {
+				break
+			}
+			count++
+			assert.Equal(t, depths[n.InternalType], iter.Depth(), "order %d node %s", order, n.InternalType)
+		}
+		assert.Equal(t, 5, count)
+		assert.Equal(t, -1, iter.Depth())
+		iter.Dispose()
+	}
+
+	iter, err := NewIterator(nodeTree().Children[1], PreOrder)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+
+	testIterNode(t, iter, "child2")
+	assert.Equal(t, 0, iter.Depth())
+	testIterNode(t, iter, "subchild21")
+	assert.Equal(t, 1, iter.Depth())
+}
+
+func TestIter_MaxDepth(t *testing.T) {
+	root := deepTree(10)
+	for _, order := range []TreeOrder{PreOrder, PostOrder, LevelOrder, PositionOrder, ReverseLevelOrder} {
+		for _, maxDepth := range []int{0, 1, 3} {
+			iter, err := NewIteratorDepth(root, order, maxDepth)
+			assert.Nil(t, err)
+
+			count := 0
+			for {
+				n, depth, err := iter.nextWithDepth(context.Background())
+				assert.Nil(t, err)
+				if n == nil {
+					break
+				}
+				assert.True(t, depth <= maxDepth, "order %d, depth %d > %d", order, depth, maxDepth)
+				count++
+			}
+			assert.Equal(t, maxDepth+1, count, "order %d, maxDepth %d", order, maxDepth)
+			iter.Dispose()
+		}
+	}
+
+	parent := nodeTree()
+	iter, err := NewIteratorDepth(parent, PostOrder, 1)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+	nodes, err := iter.ToSlice()
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{parent.Children[0], parent.Children[1], parent}, nodes)
+
+	iter, err = NewIteratorDepth(parent, PreOrder, -1)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+	nodes, err = iter.ToSlice()
+	assert.Nil(t, err)
+	assert.Len(t, nodes, 5)
+}
+
+func TestIter_IterateWithDepth(t *testing.T) {
+	depths := map[string]int{
+		"parent": 0, "child1": 1, "child2": 1, "subchild21": 2, "subchild22": 2,
+	}
+
+	orders := []TreeOrder{
+		PreOrder, PostOrder, LevelOrder, PositionOrder, ReverseLevelOrder, ReversePositionOrder,
+	}
+	for _, order := range orders {
+		iter, err := NewIterator(nodeTree(), order)
+		assert.Nil(t, err)
+
+		var expected []string
+		for {
+			n, err := iter.Next()
+			assert.Nil(t, err)
+			if n == nil {
+				break
+			}
+			expected = append(expected, n.InternalType)
+		}
+		iter.Dispose()
+
+		iter, err = NewIterator(nodeTree(), order)
+		assert.Nil(t, err)
+
+		var types []string
+		for nd := range iter.IterateWithDepth() {
+			types = append(types, nd.Node.InternalType)
+			assert.Equal(t, depths[nd.Node.InternalType], nd.Depth, "order %d node %s", order, nd.Node.InternalType)
+		}
+		assert.Equal(t, expected, types, "order %d", order)
+		assert.Len(t, types, 5)
+		iter.Dispose()
+	}
+
+	iter, err := NewIterator(nodeTree().Children[1], PostOrder)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+
+	var nds []NodeDepth
+	for nd := range iter.IterateWithDepth() {
+		nds = append(nds, nd)
+	}
+	assert.Len(t, nds, 3)
+	assert.Equal(t, 1, nds[0].Depth)
+	assert.Equal(t, "child2", nds[2].Node.InternalType)
+	assert.Equal(t, 0, nds[2].Depth)
+
+	// a finished iterator gives a closed channel
+	_, ok := <-iter.IterateWithDepth()
+	assert.False(t, ok)
+}
+
+func TestIter_IterateErr(t *testing.T) {
+	iter, err := NewIterator(nodeTree(), PreOrder)
+	assert.Nil(t, err)
+
+	nodes, errc := iter.IterateErr()
+	count := 0
+	for range nodes {
+		count++
+	}
+	assert.Equal(t, 5, count)
+	assert.Nil(t, <-errc)
+
+	iter.Dispose()
+	nodes, errc = iter.IterateErr()
+	for range nodes {
+		assert.Fail(t, "iteration over disposed iterator")
+	}
+	assert.NotNil(t, <-errc)
+	_, ok := <-errc
+	assert.False(t, ok)
+}
+
+func TestIter_IterateStopped(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	iter, err := NewIterator(nodeTree(), PreOrder)
+	assert.Nil(t, err)
+	testIterNodeChan(t, iter.Iterate(), "parent")
+	iter.Dispose()
+
+	iter, err = NewIterator(nodeTree(), PreOrder)
+	assert.Nil(t, err)
+	nodes, _ := iter.IterateErr()
+	testIterNodeChan(t, nodes, "parent")
+	iter.Dispose()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, before, runtime.NumGoroutine())
+}
+
+func testIterNodeChan(t *testing.T, c <-chan *uast.Node, nodeType string) {
+	n := <-c
+	if assert.NotNil(t, n) {
+		assert.Equal(t, nodeType, n.InternalType)
+	}
+}
+
 func TestIter_PreOrder(t *testing.T) {
 	parent := nodeTree()
 
@@ -186,3 +811,77 @@ func TestIter_PositionOrder(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Nil(t, node)
 }
+
+func TestIter_ReverseLevelOrder(t *testing.T) {
+	iter, err := NewIterator(nodeTree(), ReverseLevelOrder)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+
+	testIterNode(t, iter, "subchild22")
+	testIterNode(t, iter, "subchild21")
+	testIterNode(t, iter, "child2")
+	testIterNode(t, iter, "child1")
+	testIterNode(t, iter, "parent")
+
+	node, err := iter.Next()
+	assert.Nil(t, err)
+	assert.Nil(t, node)
+
+	_, err = iter.Next()
+	assert.NotNil(t, err)
+}
+
+func TestIter_ReversePositionOrder(t *testing.T) {
+	parent := nodeTree()
+	parent.StartPosition = &uast.Position{Offset: 0, Line: 1, Col: 1}
+	parent.Children[0].StartPosition = &uast.Position{Offset: 12, Line: 2, Col: 3}
+	parent.Children[1].Children[0].StartPosition = &uast.Position{Offset: 6, Line: 1, Col: 7}
+	parent.Children[1].Children[1].StartPosition = &uast.Position{Offset: 20, Line: 3, Col: 1}
+
+	iter, err := NewIterator(parent, ReversePositionOrder)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+
+	testIterNode(t, iter, "subchild22")
+	testIterNode(t, iter, "child1")
+	testIterNode(t, iter, "subchild21")
+	testIterNode(t, iter, "parent")
+	// child2 has no position so it comes first in PositionOrder
+	testIterNode(t, iter, "child2")
+
+	node, err := iter.Next()
+	assert.Nil(t, err)
+	assert.Nil(t, node)
+}
+
+func TestDescendantCount(t *testing.T) {
+	assert.Equal(t, 4, DescendantCount(nodeTree()))
+	assert.Equal(t, 0, DescendantCount(&uast.Node{}))
+	assert.Equal(t, 0, DescendantCount(nil))
+}
+
+func TestTokenDensity(t *testing.T) {
+	parent := nodeTree()
+	parent.Token = "parent"
+	parent.Children[0].Token = "a"
+	parent.Children[1].Children[0].Token = "b"
+	assert.Equal(t, 0.5, TokenDensity(parent))
+
+	assert.Equal(t, 0.0, TokenDensity(&uast.Node{Token: "a"}))
+	assert.Equal(t, 0.0, TokenDensity(nil))
+}
+
+func TestSameTokenNodes(t *testing.T) {
+	parent := nodeTree()
+	child1 := parent.Children[0]
+	sub21, sub22 := parent.Children[1].Children[0], parent.Children[1].Children[1]
+	child1.Token = "foo"
+	sub21.Token = "foo"
+	sub21.Roles = []uast.Role{uast.Identifier}
+	sub22.Token = "bar"
+
+	assert.Equal(t, []*uast.Node{child1, sub21}, SameTokenNodes(parent, child1))
+	assert.Equal(t, []*uast.Node{sub21}, SameTokenNodes(parent, child1, uast.Identifier))
+	assert.Equal(t, []*uast.Node{sub21}, SameTokenNodes(parent.Children[1], child1))
+	assert.Len(t, SameTokenNodes(parent, parent), 0)
+}
@@ -0,0 +1,130 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// jsonNode is the JSON schema of a node written by ToJSON.
+type jsonNode struct {
+	InternalType  string            `json:"internalType"`
+	Token         string            `json:"token,omitempty"`
+	Roles         []string          `json:"roles,omitempty"`
+	Properties    map[string]string `json:"properties,omitempty"`
+	StartPosition *jsonPosition     `json:"startPosition,omitempty"`
+	EndPosition   *jsonPosition     `json:"endPosition,omitempty"`
+	Children      []*jsonNode       `json:"children,omitempty"`
+}
+
+type jsonPosition struct {
+	Offset uint32 `json:"offset"`
+	Line   uint32 `json:"line"`
+	Col    uint32 `json:"col"`
+}
+
+// ToJSON encodes the tree rooted at node as JSON. Every node is an object with
+// the fields `internalType`, `token`, `roles` (a list of role names, as
+// returned by RoleName), `properties`, `startPosition` and `endPosition` (both
+// objects with `offset`, `line` and `col`) and `children`, all of them but the
+// internal type omitted when empty. The output is deterministic: the fields are
+// always written in that order and the properties sorted by key. An
+// *ErrInvalidArgument error is returned if a node has a role unknown to the SDK.
+func ToJSON(node *uast.Node) ([]byte, error) {
+	n, err := toJSONNode(node)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(n)
+}
+
+func toJSONNode(node *uast.Node) (*jsonNode, error) {
+	if node == nil {
+		return nil, nil
+	}
+
+	n := &jsonNode{
+		InternalType:  node.InternalType,
+		Token:         node.Token,
+		Properties:    node.Properties,
+		StartPosition: toJSONPosition(node.StartPosition),
+		EndPosition:   toJSONPosition(node.EndPosition),
+	}
+
+	for _, r := range node.Roles {
+		name := RoleName(r)
+		if name == "" {
+			return nil, &ErrInvalidArgument{Message: fmt.Sprintf("unknown role %d", int(r))}
+		}
+		n.Roles = append(n.Roles, name)
+	}
+
+	for _, child := range nonNilChildren(node) {
+		c, err := toJSONNode(child)
+		if err != nil {
+			return nil, err
+		}
+		n.Children = append(n.Children, c)
+	}
+	return n, nil
+}
+
+func toJSONPosition(p *uast.Position) *jsonPosition {
+	if p == nil {
+		return nil
+	}
+	return &jsonPosition{Offset: p.Offset, Line: p.Line, Col: p.Col}
+}
+
+// FromJSON decodes a tree encoded by ToJSON. An *ErrInvalidArgument error is
+// returned if a role name is not known.
+func FromJSON(data []byte) (*uast.Node, error) {
+	var n *jsonNode
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, err
+	}
+	return fromJSONNode(n)
+}
+
+func fromJSONNode(n *jsonNode) (*uast.Node, error) {
+	if n == nil {
+		return nil, nil
+	}
+
+	node := &uast.Node{
+		InternalType:  n.InternalType,
+		Token:         n.Token,
+		Properties:    n.Properties,
+		StartPosition: fromJSONPosition(n.StartPosition),
+		EndPosition:   fromJSONPosition(n.EndPosition),
+	}
+
+	for _, name := range n.Roles {
+		r, ok := RoleByName(name)
+		if !ok {
+			return nil, &ErrInvalidArgument{Message: fmt.Sprintf("unknown role %q", name)}
+		}
+		node.Roles = append(node.Roles, r)
+	}
+
+	for _, child := range n.Children {
+		if child == nil {
+			continue
+		}
+
+		c, err := fromJSONNode(child)
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, c)
+	}
+	return node, nil
+}
+
+func fromJSONPosition(p *jsonPosition) *uast.Position {
+	if p == nil {
+		return nil
+	}
+	return &uast.Position{Offset: p.Offset, Line: p.Line, Col: p.Col}
+}
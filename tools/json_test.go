@@ -0,0 +1,56 @@
+package tools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+func TestToJSON(t *testing.T) {
+	n := &uast.Node{
+		InternalType: "Module",
+		Roles:        []uast.Role{uast.File, uast.Module},
+		Properties:   map[string]string{"b": "2", "a": "1"},
+		Children: []*uast.Node{{
+			InternalType:  "Name",
+			Token:         "foo",
+			Roles:         []uast.Role{uast.Identifier},
+			StartPosition: &uast.Position{Offset: 0, Line: 1, Col: 1},
+			EndPosition:   &uast.Position{Offset: 3, Line: 1, Col: 4},
+		}},
+	}
+
+	data, err := ToJSON(n)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"internalType":"Module","roles":["File","Module"],"properties":{"a":"1","b":"2"},`+
+		`"children":[{"internalType":"Name","token":"foo","roles":["Identifier"],`+
+		`"startPosition":{"offset":0,"line":1,"col":1},"endPosition":{"offset":3,"line":1,"col":4}}]}`,
+		string(data))
+
+	again, err := ToJSON(n)
+	assert.Nil(t, err)
+	assert.Equal(t, data, again)
+
+	r, err := FromJSON(data)
+	assert.Nil(t, err)
+	assert.True(t, Equal(n, r))
+	assert.Equal(t, n, r)
+
+	_, err = ToJSON(&uast.Node{Roles: []uast.Role{uast.Role(-1)}})
+	assert.IsType(t, &ErrInvalidArgument{}, err)
+
+	_, err = FromJSON([]byte(`{"internalType":"a","roles":["NotARole"]}`))
+	assert.IsType(t, &ErrInvalidArgument{}, err)
+
+	_, err = FromJSON([]byte(`{"internalType":`))
+	assert.NotNil(t, err)
+
+	data, err = ToJSON(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "null", string(data))
+	r, err = FromJSON(data)
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+}
@@ -0,0 +1,148 @@
+#ifndef CLIENT_GO_NODES_H_
+#define CLIENT_GO_NODES_H_
+
+// The node interface given to libuast, calling the Go callbacks, and the
+// helpers shared by the cgo files. Every file including it gets its own copy
+// of these static functions, so they must not keep any state: the state of
+// libuast lives in bindings.h, which is only included by bindings.go.
+
+#include <inttypes.h>
+#include <stdarg.h>
+#include <stdbool.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include <libxml/tree.h>
+#include <libxml/xmlerror.h>
+#include <libxml/xpath.h>
+#include <libxml/xpathInternals.h>
+
+#if __has_include("roles.h")
+#include "roles.h"
+#else
+#include "libuast/roles.h"
+#endif
+
+extern char* goGetInternalType(uintptr_t);
+extern char* goGetToken(uintptr_t);
+extern bool goHasToken(uintptr_t);
+extern bool goHasSameToken(uintptr_t, uintptr_t);
+extern int goGetChildrenSize(uintptr_t);
+extern uintptr_t goGetChild(uintptr_t, int);
+extern int goGetRolesSize(uintptr_t);
+extern uint16_t goGetRole(uintptr_t, int);
+extern int goGetPropertiesSize(uintptr_t);
+extern char* goGetPropertyKey(uintptr_t, int);
+extern char* goGetPropertyValue(uintptr_t, int);
+extern bool goHasStartOffset(uintptr_t);
+extern uint32_t goGetStartOffset(uintptr_t);
+extern bool goHasStartLine(uintptr_t);
+extern uint32_t goGetStartLine(uintptr_t);
+extern bool goHasStartCol(uintptr_t);
+extern uint32_t goGetStartCol(uintptr_t);
+extern bool goHasEndOffset(uintptr_t);
+extern uint32_t goGetEndOffset(uintptr_t);
+extern bool goHasEndLine(uintptr_t);
+extern uint32_t goGetEndLine(uintptr_t);
+extern bool goHasEndCol(uintptr_t);
+extern uint32_t goGetEndCol(uintptr_t);
+extern int goCallXPathFunction(uintptr_t, char*, char**, int, bool*, double*, char**);
+
+static const char *InternalType(const void *node) {
+  return goGetInternalType((uintptr_t)node);
+}
+
+static const char *Token(const void *node) {
+  return goGetToken((uintptr_t)node);
+}
+
+static size_t ChildrenSize(const void *node) {
+  return goGetChildrenSize((uintptr_t)node);
+}
+
+static void *ChildAt(const void *data, int index) {
+  return (void*)goGetChild((uintptr_t)data, index);
+}
+
+static size_t RolesSize(const void *node) {
+  return goGetRolesSize((uintptr_t)node);
+}
+
+static uint16_t RoleAt(const void *node, int index) {
+  return goGetRole((uintptr_t)node, index);
+}
+
+static size_t PropertiesSize(const void *node) {
+  return goGetPropertiesSize((uintptr_t)node);
+}
+
+static const char *PropertyKeyAt(const void *node, int index) {
+  return goGetPropertyKey((uintptr_t)node, index);
+}
+
+static const char *PropertyValueAt(const void *node, int index) {
+  return goGetPropertyValue((uintptr_t)node, index);
+}
+
+static bool HasStartOffset(const void *node) {
+  return goHasStartOffset((uintptr_t)node);
+}
+
+static uint32_t StartOffset(const void *node) {
+  return goGetStartOffset((uintptr_t)node);
+}
+
+static bool HasStartLine(const void *node) {
+  return goHasStartLine((uintptr_t)node);
+}
+
+static uint32_t StartLine(const void *node) {
+  return goGetStartLine((uintptr_t)node);
+}
+
+static bool HasStartCol(const void *node) {
+  return goHasStartCol((uintptr_t)node);
+}
+
+static uint32_t StartCol(const void *node) {
+  return goGetStartCol((uintptr_t)node);
+}
+
+static bool HasEndOffset(const void *node) {
+  return goHasEndOffset((uintptr_t)node);
+}
+
+static uint32_t EndOffset(const void *node) {
+  return goGetEndOffset((uintptr_t)node);
+}
+
+static bool HasEndLine(const void *node) {
+  return goHasEndLine((uintptr_t)node);
+}
+
+static uint32_t EndLine(const void *node) {
+  return goGetEndLine((uintptr_t)node);
+}
+
+static bool HasEndCol(const void *node) {
+  return goHasEndCol((uintptr_t)node);
+}
+
+static uint32_t EndCol(const void *node) {
+  return goGetEndCol((uintptr_t)node);
+}
+
+// LastXPathError returns the xmlXPathError code of the last libxml2 error of
+// the calling thread, or -1 if it is not an XPath error. libxml2 keeps the last
+// error per thread, so it has to be read by the same C call which failed.
+static int LastXPathError() {
+  xmlErrorPtr err = xmlGetLastError();
+  if (!err || err->domain != XML_FROM_XPATH) {
+    return -1;
+  }
+  return err->code - XML_XPATH_EXPRESSION_OK + XPATH_EXPRESSION_OK;
+}
+
+#endif // CLIENT_GO_NODES_H_
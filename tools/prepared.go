@@ -0,0 +1,292 @@
+package tools
+
+// #include "prepared.h"
+import "C"
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// PreparedQuery is an XPath query compiled once to be run over many trees,
+// which saves parsing the query on every call. Most of the time of a query is
+// still spent building the libxml2 document of the tree, which has to be done
+// for every tree.
+// PreparedQuery is thread-safe but not concurrent by an internal lock of each
+// query.
+type PreparedQuery struct {
+	xpath string
+
+	mu    sync.Mutex
+	expr  C.xmlXPathCompExprPtr
+	funcs map[string]XPathFunction
+	table nodeTable
+}
+
+// XPathFunction is a Go function that can be called from the XPath queries of
+// a PreparedQuery it has been registered in. The arguments are given as the
+// XPath string values of the ones in the query, so a node-set argument such
+// as @token is the value of its first node, or "" if it is empty. The result
+// must be a bool, a string, an int or a float64; returning an error, or a
+// value of another type, makes the query fail with a *FilterError of kind
+// RuntimeError.
+type XPathFunction func(args []interface{}) (interface{}, error)
+
+// Prepare compiles the xpath query, returning a *FilterError if it is not
+// valid. The query must be closed once it is not needed anymore to free the
+// compiled expression.
+func Prepare(xpath string) (*PreparedQuery, error) {
+	cquery := C.CString(xpath)
+	defer C.free(unsafe.Pointer(cquery))
+
+	cerror := newPreparedError()
+	defer C.free(unsafe.Pointer(cerror))
+
+	var code C.int
+	rlockUast()
+	expr := C.PreparedCompile(cquery, cerror, &code)
+	uastMutex.RUnlock()
+	if expr == nil {
+		return nil, newFilterError(xpath, C.GoString(cerror), code)
+	}
+	return &PreparedQuery{xpath: xpath, expr: expr}, nil
+}
+
+// ValidateXPath compiles the xpath query with libxml2, without running it,
+// and returns the *FilterError of the compilation if it is not valid, usually
+// of kind SyntaxError. Some errors are only found when running a query, like
+// calling an unknown function or referencing an unbound variable, which are
+// not reported.
+func ValidateXPath(xpath string) error {
+	q, err := Prepare(xpath)
+	if err != nil {
+		return err
+	}
+	q.Close()
+	return nil
+}
+
+// newPreparedError returns the C buffer where a call on a prepared query
+// writes its error, to be freed by the caller.
+func newPreparedError() *C.char {
+	return (*C.char)(C.calloc(C.PREPARED_ERROR_SIZE, 1))
+}
+
+// String returns the query the PreparedQuery was compiled from.
+func (q *PreparedQuery) String() string {
+	return q.xpath
+}
+
+// Filter returns the list of nodes of the tree that satisfy the query, like
+// the package level Filter function. An *ErrInvalidArgument error is returned
+// if the query has been closed.
+func (q *PreparedQuery) Filter(node *uast.Node) ([]*uast.Node, error) {
+	return q.FilterWithVars(node, nil)
+}
+
+// FilterWithVars is like Filter but binds the given XPath variables before
+// evaluating the query, see the package level FilterWithVars function.
+func (q *PreparedQuery) FilterWithVars(node *uast.Node, vars map[string]string) ([]*uast.Node, error) {
+	var results []*uast.Node
+	err := q.run(node, vars, func(handles []C.uintptr_t) {
+		results = make([]*uast.Node, len(handles))
+		for i, ptr := range handles {
+			results[i] = ptrToNode(ptr)
+		}
+	})
+	return results, err
+}
+
+// count returns the number of nodes of the tree that satisfy the query,
+// without building the list of nodes.
+func (q *PreparedQuery) count(node *uast.Node) (int, error) {
+	var count int
+	err := q.run(node, nil, func(handles []C.uintptr_t) {
+		count = len(handles)
+	})
+	return count, err
+}
+
+// run evaluates the query over the tree binding the given variables, and
+// calls fn with the handles of the resulting nodes while they are valid. fn
+// is not called if node is nil or the query fails.
+func (q *PreparedQuery) run(node *uast.Node, vars map[string]string, fn func(handles []C.uintptr_t)) error {
+	if node == nil {
+		return nil
+	}
+
+	for name := range vars {
+		if !isXPathName(name) {
+			return &ErrInvalidArgument{Message: fmt.Sprintf("invalid variable name %q", name)}
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.expr == nil {
+		return &ErrInvalidArgument{Message: "filter with closed prepared query"}
+	}
+
+	if err := q.table.acquire(); err != nil {
+		return err
+	}
+	defer q.table.release()
+
+	var names, values []*C.char
+	for name, value := range vars {
+		names = append(names, q.table.pool.getCstring(name))
+		values = append(values, q.table.pool.getCstring(value))
+	}
+
+	var cnames, cvalues **C.char
+	if len(names) > 0 {
+		cnames, cvalues = &names[0], &values[0]
+	}
+
+	var funcs []*C.char
+	for name := range q.funcs {
+		funcs = append(funcs, q.table.pool.getCstring(name))
+	}
+
+	var cfuncs **C.char
+	if len(funcs) > 0 {
+		cfuncs = &funcs[0]
+	}
+	q.table.funcs = q.funcs
+
+	cerror := newPreparedError()
+	defer C.free(unsafe.Pointer(cerror))
+
+	var size, code C.int
+	rlockUast()
+	ptrs := C.PreparedFilter(q.table.handle(node), q.expr, cnames, cvalues, C.int(len(names)),
+		cfuncs, C.int(len(funcs)), &size, cerror, &code)
+	uastMutex.RUnlock()
+	if size < 0 {
+		if q.table.funcErr != nil {
+			return &FilterError{Query: q.xpath, Kind: RuntimeError, Msg: q.table.funcErr.Error()}
+		}
+		return newFilterError(q.xpath, C.GoString(cerror), code)
+	}
+	defer C.free(unsafe.Pointer(ptrs))
+
+	nu := int(size)
+	fn((*[1 << 28]C.uintptr_t)(unsafe.Pointer(ptrs))[:nu:nu])
+	return nil
+}
+
+// RegisterFunction makes fn callable by name from the query, and replaces the
+// function registered before with the same name if any. The name can't have a
+// namespace prefix nor be the one of an XPath built-in function, which makes
+// the query fail to run. The function is only registered in this query, and
+// it's called from the goroutine running the query.
+func (q *PreparedQuery) RegisterFunction(name string, fn XPathFunction) error {
+	if !isXPathName(name) {
+		return &ErrInvalidArgument{Message: fmt.Sprintf("invalid function name %q", name)}
+	}
+	if fn == nil {
+		return &ErrInvalidArgument{Message: "nil function"}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.funcs == nil {
+		q.funcs = make(map[string]XPathFunction)
+	}
+	q.funcs[name] = fn
+	return nil
+}
+
+//export goCallXPathFunction
+func goCallXPathFunction(ptr C.uintptr_t, name *C.char, cargs **C.char, nargs C.int,
+	boolean *C.bool, number *C.double, str **C.char) C.int {
+
+	t := tableOf(ptr)
+	if t.funcErr != nil {
+		return C.XPATH_FUNCTION_ERROR
+	}
+
+	n := int(nargs)
+	args := make([]interface{}, n)
+	if n > 0 {
+		for i, arg := range (*[1 << 28]*C.char)(unsafe.Pointer(cargs))[:n:n] {
+			args[i] = C.GoString(arg)
+		}
+	}
+
+	fname := C.GoString(name)
+	result, err := t.funcs[fname](args)
+	if err != nil {
+		t.funcErr = err
+		return C.XPATH_FUNCTION_ERROR
+	}
+
+	switch v := result.(type) {
+	case bool:
+		*boolean = C.bool(v)
+		return C.XPATH_FUNCTION_BOOLEAN
+	case int:
+		*number = C.double(v)
+		return C.XPATH_FUNCTION_NUMBER
+	case float64:
+		*number = C.double(v)
+		return C.XPATH_FUNCTION_NUMBER
+	case string:
+		*str = C.CString(v)
+		return C.XPATH_FUNCTION_STRING
+	}
+
+	t.funcErr = fmt.Errorf("function %s returned unsupported type %T", fname, result)
+	return C.XPATH_FUNCTION_ERROR
+}
+
+// isXPathName reports whether name can be used as an XPath variable or
+// function name, which is a name without a namespace prefix.
+func isXPathName(name string) bool {
+	if name == "" || !isNameStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterWithVars returns the list of nodes of the tree that satisfy the query
+// once its variable references are bound to the given values, e.g. the
+// query `//*[@token=$name]` with vars {"name": "foo"}. The values are bound as
+// XPath strings, without any parsing, so they need no escaping and can't
+// change the meaning of the query; use number() in the query to compare them
+// as numbers. A variable referenced by the query but missing in vars results
+// in a *FilterError of kind SyntaxError, and a name which is not a valid
+// XPath name (without the leading $) in an *ErrInvalidArgument.
+//
+// The query is compiled on every call, use Prepare and
+// PreparedQuery.FilterWithVars to run it many times.
+func FilterWithVars(node *uast.Node, xpath string, vars map[string]string) ([]*uast.Node, error) {
+	q, err := Prepare(xpath)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	return q.FilterWithVars(node, vars)
+}
+
+// Close frees the compiled query. It can be called more than once.
+func (q *PreparedQuery) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.expr != nil {
+		C.xmlXPathFreeCompExpr(q.expr)
+		q.expr = nil
+	}
+}
@@ -0,0 +1,260 @@
+#ifndef CLIENT_GO_PREPARED_H_
+#define CLIENT_GO_PREPARED_H_
+
+#include "nodes_go.h"
+
+// Prepared queries are compiled once with libxml2 and evaluated over a document
+// built here as libuast does, since libuast only evaluates query strings. Their
+// errors are written in the PREPARED_ERROR_SIZE bytes buffer given by the
+// caller, which is set as the context of the libxml2 error handler during the
+// call: libxml2 keeps the handler per thread, so concurrent calls don't write
+// in the buffer of each other, as libuast errors do. The LastXPathError of the
+// call is written in code.
+#define PREPARED_ERROR_SIZE 256
+
+static void PreparedErrorHandler(void *ctx, const char *msg, ...) {
+  if (!ctx) {
+    return;
+  }
+
+  va_list args;
+  va_start(args, msg);
+  vsnprintf((char*)ctx, PREPARED_ERROR_SIZE, msg, args);
+  va_end(args);
+}
+
+static void SetPreparedErrorHandler(char *error) {
+  xmlSetGenericErrorFunc(error, (xmlGenericErrorFunc)PreparedErrorHandler);
+}
+
+static xmlXPathCompExprPtr PreparedCompile(const char *query, char *error,
+                                           int *code) {
+  SetPreparedErrorHandler(error);
+  xmlResetLastError();
+  xmlXPathCompExprPtr expr = xmlXPathCompile(BAD_CAST(query));
+  *code = LastXPathError();
+  SetPreparedErrorHandler(NULL);
+  return expr;
+}
+
+static bool SetUintProp(xmlNodePtr xmlNode, const char *name, uint32_t value) {
+  char buf[16];
+  snprintf(buf, sizeof(buf), "%" PRIu32, value);
+  return xmlNewProp(xmlNode, BAD_CAST(name), BAD_CAST(buf)) != NULL;
+}
+
+static bool SetProps(void *node, xmlNodePtr xmlNode) {
+  const char *token = Token(node);
+  if (token && !xmlNewProp(xmlNode, BAD_CAST("token"), BAD_CAST(token))) {
+    return false;
+  }
+
+  size_t roles = RolesSize(node);
+  for (size_t i = 0; i < roles; i++) {
+    const char *name = RoleNameForId(RoleAt(node, i));
+    if (name && !xmlNewProp(xmlNode, BAD_CAST(name), NULL)) {
+      return false;
+    }
+  }
+
+  size_t props = PropertiesSize(node);
+  for (size_t i = 0; i < props; i++) {
+    const char *key = PropertyKeyAt(node, i);
+    const char *value = PropertyValueAt(node, i);
+    if (!xmlNewProp(xmlNode, BAD_CAST(key), BAD_CAST(value))) {
+      return false;
+    }
+  }
+
+  return (!HasStartOffset(node) || SetUintProp(xmlNode, "startOffset", StartOffset(node))) &&
+         (!HasStartLine(node) || SetUintProp(xmlNode, "startLine", StartLine(node))) &&
+         (!HasStartCol(node) || SetUintProp(xmlNode, "startCol", StartCol(node))) &&
+         (!HasEndOffset(node) || SetUintProp(xmlNode, "endOffset", EndOffset(node))) &&
+         (!HasEndLine(node) || SetUintProp(xmlNode, "endLine", EndLine(node))) &&
+         (!HasEndCol(node) || SetUintProp(xmlNode, "endCol", EndCol(node)));
+}
+
+static xmlNodePtr PreparedXmlNode(void *node) {
+  xmlNodePtr xmlNode = xmlNewNode(NULL, BAD_CAST(InternalType(node)));
+  if (!xmlNode) {
+    return NULL;
+  }
+  xmlNode->_private = node;
+
+  if (!SetProps(node, xmlNode)) {
+    xmlFreeNode(xmlNode);
+    return NULL;
+  }
+
+  size_t children = ChildrenSize(node);
+  for (size_t i = 0; i < children; i++) {
+    xmlNodePtr child = PreparedXmlNode(ChildAt(node, i));
+    if (!child) {
+      xmlFreeNode(xmlNode);
+      return NULL;
+    }
+    if (!xmlAddChild(xmlNode, child)) {
+      xmlFreeNode(child);
+      xmlFreeNode(xmlNode);
+      return NULL;
+    }
+  }
+  return xmlNode;
+}
+
+enum {
+  XPATH_FUNCTION_ERROR,
+  XPATH_FUNCTION_BOOLEAN,
+  XPATH_FUNCTION_NUMBER,
+  XPATH_FUNCTION_STRING,
+};
+
+// PreparedFunction calls the Go function registered with the name of the
+// function being evaluated, with the string values of its arguments.
+static void PreparedFunction(xmlXPathParserContextPtr ctxt, int nargs) {
+  char **args = calloc(nargs > 0 ? nargs : 1, sizeof(char*));
+  if (!args) {
+    xmlXPathSetError(ctxt, XPATH_MEMORY_ERROR);
+    return;
+  }
+
+  for (int i = nargs - 1; i >= 0; i--) {
+    args[i] = (char*)xmlXPathPopString(ctxt);
+    if (ctxt->error != XPATH_EXPRESSION_OK) {
+      break;
+    }
+  }
+
+  int type = XPATH_FUNCTION_ERROR;
+  bool boolean = false;
+  double number = 0;
+  char *str = NULL;
+  if (ctxt->error == XPATH_EXPRESSION_OK) {
+    type = goCallXPathFunction((uintptr_t)ctxt->context->userData,
+                               (char*)ctxt->context->function, args, nargs,
+                               &boolean, &number, &str);
+  }
+
+  for (int i = 0; i < nargs; i++) {
+    xmlFree(args[i]);
+  }
+  free(args);
+
+  switch (type) {
+  case XPATH_FUNCTION_BOOLEAN:
+    valuePush(ctxt, xmlXPathNewBoolean(boolean));
+    break;
+  case XPATH_FUNCTION_NUMBER:
+    valuePush(ctxt, xmlXPathNewFloat(number));
+    break;
+  case XPATH_FUNCTION_STRING:
+    valuePush(ctxt, xmlXPathNewString(BAD_CAST(str)));
+    free(str);
+    break;
+  default:
+    if (ctxt->error == XPATH_EXPRESSION_OK) {
+      xmlXPathSetError(ctxt, XPATH_EXPR_ERROR);
+    }
+  }
+}
+
+static uintptr_t *preparedFilter(uintptr_t node_ptr, xmlXPathCompExprPtr expr,
+                                 const char **names, const char **values,
+                                 int nvars, const char **funcs, int nfuncs,
+                                 int *size, char *error) {
+  static const char *types[] = {
+      "UNDEFINED", "NODESET", "BOOLEAN", "NUMBER", "STRING",
+      "POINT", "RANGE", "LOCATIONSET", "USERS", "XSLT_TREE",
+  };
+
+  *size = -1;
+
+  xmlDocPtr doc = xmlNewDoc(BAD_CAST("1.0"));
+  if (!doc) {
+    snprintf(error, PREPARED_ERROR_SIZE, "Unable to create the document");
+    return NULL;
+  }
+
+  xmlNodePtr root = PreparedXmlNode((void*)node_ptr);
+  if (!root) {
+    snprintf(error, PREPARED_ERROR_SIZE, "Unable to create the document nodes");
+    xmlFreeDoc(doc);
+    return NULL;
+  }
+  xmlDocSetRootElement(doc, root);
+
+  xmlXPathContextPtr xpathCtx = xmlXPathNewContext(doc);
+  if (!xpathCtx) {
+    snprintf(error, PREPARED_ERROR_SIZE, "Unable to create the XPath context");
+    xmlFreeDoc(doc);
+    return NULL;
+  }
+
+  for (int i = 0; i < nvars; i++) {
+    xmlXPathObjectPtr value = xmlXPathNewString(BAD_CAST(values[i]));
+    if (!value || xmlXPathRegisterVariable(xpathCtx, BAD_CAST(names[i]), value) != 0) {
+      snprintf(error, PREPARED_ERROR_SIZE, "Unable to bind variable %s", names[i]);
+      xmlXPathFreeObject(value);
+      xmlXPathFreeContext(xpathCtx);
+      xmlFreeDoc(doc);
+      return NULL;
+    }
+  }
+
+  xpathCtx->userData = (void*)node_ptr;
+  for (int i = 0; i < nfuncs; i++) {
+    if (xmlXPathRegisterFunc(xpathCtx, BAD_CAST(funcs[i]), PreparedFunction) != 0) {
+      snprintf(error, PREPARED_ERROR_SIZE, "Unable to register function %s", funcs[i]);
+      xmlXPathFreeContext(xpathCtx);
+      xmlFreeDoc(doc);
+      return NULL;
+    }
+  }
+
+  uintptr_t *results = NULL;
+  xmlXPathObjectPtr obj = xmlXPathCompiledEval(expr, xpathCtx);
+  if (obj && obj->type != XPATH_NODESET) {
+    snprintf(error, PREPARED_ERROR_SIZE,
+             "Result of expression is not NODESET (is: %s)",
+             obj->type < sizeof(types) / sizeof(types[0]) ? types[obj->type] : "UNDEFINED");
+  } else if (obj) {
+    xmlNodeSetPtr nodeset = obj->nodesetval;
+    int total = nodeset ? nodeset->nodeNr : 0;
+    results = malloc((total > 0 ? total : 1) * sizeof(uintptr_t));
+    if (!results) {
+      snprintf(error, PREPARED_ERROR_SIZE, "Unable to get memory for nodes");
+    } else {
+      int count = 0;
+      for (int i = 0; i < total; i++) {
+        if (nodeset->nodeTab[i] && nodeset->nodeTab[i]->_private) {
+          results[count++] = (uintptr_t)nodeset->nodeTab[i]->_private;
+        }
+      }
+      *size = count;
+    }
+  }
+
+  xmlXPathFreeObject(obj);
+  xmlXPathFreeContext(xpathCtx);
+  xmlFreeDoc(doc);
+  return results;
+}
+
+// PreparedFilter returns the nodes matching the compiled expression, to be
+// freed by the caller, and their number in size, which is -1 on errors. The
+// nvars variables in names and values are bound as strings and the nfuncs
+// functions are registered to call the Go ones before evaluating.
+static uintptr_t *PreparedFilter(uintptr_t node_ptr, xmlXPathCompExprPtr expr,
+                                 const char **names, const char **values,
+                                 int nvars, const char **funcs, int nfuncs,
+                                 int *size, char *error, int *code) {
+  SetPreparedErrorHandler(error);
+  xmlResetLastError();
+  uintptr_t *results = preparedFilter(node_ptr, expr, names, values, nvars,
+                                      funcs, nfuncs, size, error);
+  *code = LastXPathError();
+  SetPreparedErrorHandler(NULL);
+  return results;
+}
+
+#endif // CLIENT_GO_PREPARED_H_
@@ -0,0 +1,351 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+func TestPreparedQuery(t *testing.T) {
+	n := nodeTree()
+	n.Children[0].Token = "a"
+	n.Children[0].Roles = []uast.Role{uast.Identifier}
+	n.Children[1].Properties = map[string]string{"k": "v"}
+	n.Children[1].StartPosition = &uast.Position{Offset: 4, Line: 1, Col: 5}
+
+	queries := []string{
+		"//*", "/*", "//child2/*", "//child3", "//*[@token='a']", "//*[@roleIdentifier]",
+		"//*[@k='v']", "//*[@startOffset=4][@startLine=1][@startCol=5]", "//@token",
+	}
+
+	for _, query := range queries {
+		expected, err := Filter(n, query)
+		assert.Nil(t, err)
+
+		q, err := Prepare(query)
+		assert.Nil(t, err)
+		assert.Equal(t, query, q.String())
+
+		for i := 0; i < 2; i++ {
+			r, err := q.Filter(n)
+			assert.Nil(t, err, query)
+			assert.Equal(t, expected, r, query)
+		}
+		q.Close()
+	}
+}
+
+func TestPreparedQuery_Errors(t *testing.T) {
+	_, err := Prepare("//*[")
+	assert.Equal(t, &FilterError{Query: "//*[", Kind: SyntaxError, Msg: "Invalid expression"}, err)
+
+	q, err := Prepare("count(//*)")
+	assert.Nil(t, err)
+
+	_, err = q.Filter(nodeTree())
+	assert.Equal(t, &FilterError{
+		Query: "count(//*)",
+		Kind:  ResultTypeError,
+		Msg:   "Result of expression is not NODESET (is: NUMBER)",
+	}, err)
+
+	r, err := q.Filter(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+
+	q.Close()
+	q.Close()
+	_, err = q.Filter(nodeTree())
+	assert.IsType(t, &ErrInvalidArgument{}, err)
+}
+
+func TestValidateXPath(t *testing.T) {
+	for _, query := range []string{"//*", "//*[@roleIdentifier][1]/@token", "count(//*)", "//*[$x]"} {
+		assert.Nil(t, ValidateXPath(query), query)
+	}
+
+	for _, query := range []string{"", ":", "//*[", "//a[@token='b]", "//*[@token=]"} {
+		err := ValidateXPath(query)
+		assert.IsType(t, &FilterError{}, err, query)
+		if err != nil {
+			assert.Equal(t, SyntaxError, err.(*FilterError).Kind, query)
+			assert.Equal(t, query, err.(*FilterError).Query)
+		}
+	}
+}
+
+func TestFilterWithVars(t *testing.T) {
+	n := nodeTree()
+	n.Children[0].Token = `it's "quoted"`
+	n.Children[1].Token = "b"
+	n.Children[1].StartPosition = &uast.Position{Offset: 4}
+
+	r, err := FilterWithVars(n, "//*[@token=$token]", map[string]string{"token": `it's "quoted"`})
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n.Children[0]}, r)
+
+	r, err = FilterWithVars(n, "//*[@token=$token]", map[string]string{"token": "' or '1'='1"})
+	assert.Nil(t, err)
+	assert.Len(t, r, 0)
+
+	r, err = FilterWithVars(n, "//*[@startOffset>=number($min)][@token!=$a]", map[string]string{
+		"min": "3",
+		"a":   "c",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n.Children[1]}, r)
+
+	_, err = FilterWithVars(n, "//*[@token=$missing]", nil)
+	assert.Equal(t, &FilterError{Query: "//*[@token=$missing]", Kind: SyntaxError, Msg: "Undefined variable"}, err)
+
+	_, err = FilterWithVars(n, "//*[@token=$a]", map[string]string{"$a": "b"})
+	assert.IsType(t, &ErrInvalidArgument{}, err)
+
+	q, err := Prepare("//*[@token=$token]")
+	assert.Nil(t, err)
+	defer q.Close()
+
+	for _, token := range []string{"b", "c"} {
+		r, err := q.FilterWithVars(n, map[string]string{"token": token})
+		assert.Nil(t, err)
+		expected, err := Filter(n, "//*[@token='"+token+"']")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, r)
+	}
+}
+
+func TestPreparedQuery_RegisterFunction(t *testing.T) {
+	n := nodeTree()
+	n.Children[0].Token = "snake_case"
+	n.Children[1].Token = "camelCase"
+
+	q, err := Prepare("//*[isSnakeCase(@token)]")
+	assert.Nil(t, err)
+	defer q.Close()
+
+	var calls [][]interface{}
+	err = q.RegisterFunction("isSnakeCase", func(args []interface{}) (interface{}, error) {
+		calls = append(calls, args)
+		return strings.ToLower(args[0].(string)) == args[0].(string) &&
+			strings.Contains(args[0].(string), "_"), nil
+	})
+	assert.Nil(t, err)
+
+	r, err := q.Filter(n)
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n.Children[0]}, r)
+	assert.Len(t, calls, 5)
+	assert.Contains(t, calls, []interface{}{"camelCase"})
+	assert.Contains(t, calls, []interface{}{""})
+
+	q2, err := Prepare("//*[concat(upper(@token), '!') = 'SNAKE_CASE!'][half(4) = 2][join('a', 'b', 3) = 'a-b-3']")
+	assert.Nil(t, err)
+	defer q2.Close()
+
+	assert.Nil(t, q2.RegisterFunction("upper", func(args []interface{}) (interface{}, error) {
+		return strings.ToUpper(args[0].(string)), nil
+	}))
+	assert.Nil(t, q2.RegisterFunction("half", func(args []interface{}) (interface{}, error) {
+		return 2, nil
+	}))
+	assert.Nil(t, q2.RegisterFunction("join", func(args []interface{}) (interface{}, error) {
+		parts := make([]string, len(args))
+		for i, arg := range args {
+			parts[i] = arg.(string)
+		}
+		return strings.Join(parts, "-"), nil
+	}))
+
+	r, err = q2.Filter(n)
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n.Children[0]}, r)
+}
+
+func TestPreparedQuery_RegisterFunctionErrors(t *testing.T) {
+	q, err := Prepare("//*[fail(@token)]")
+	assert.Nil(t, err)
+	defer q.Close()
+
+	assert.IsType(t, &ErrInvalidArgument{}, q.RegisterFunction("ns:fail", func([]interface{}) (interface{}, error) {
+		return nil, nil
+	}))
+	assert.IsType(t, &ErrInvalidArgument{}, q.RegisterFunction("fail", nil))
+
+	_, err = q.Filter(nodeTree())
+	assert.Equal(t, &FilterError{Query: "//*[fail(@token)]", Kind: SyntaxError, Msg: "Unregistered function"}, err)
+
+	assert.Nil(t, q.RegisterFunction("fail", func([]interface{}) (interface{}, error) {
+		return nil, errors.New("failed")
+	}))
+	_, err = q.Filter(nodeTree())
+	assert.Equal(t, &FilterError{Query: "//*[fail(@token)]", Kind: RuntimeError, Msg: "failed"}, err)
+
+	assert.Nil(t, q.RegisterFunction("fail", func([]interface{}) (interface{}, error) {
+		return []string{}, nil
+	}))
+	_, err = q.Filter(nodeTree())
+	assert.Equal(t, &FilterError{
+		Query: "//*[fail(@token)]",
+		Kind:  RuntimeError,
+		Msg:   "function fail returned unsupported type []string",
+	}, err)
+
+	// the errors of a call are not kept for the next ones
+	assert.Nil(t, q.RegisterFunction("fail", func([]interface{}) (interface{}, error) {
+		return false, nil
+	}))
+	r, err := q.Filter(nodeTree())
+	assert.Nil(t, err)
+	assert.Len(t, r, 0)
+
+	q2, err := Prepare("//*[count(.)]")
+	assert.Nil(t, err)
+	defer q2.Close()
+
+	assert.Nil(t, q2.RegisterFunction("count", func([]interface{}) (interface{}, error) {
+		return true, nil
+	}))
+	_, err = q2.Filter(nodeTree())
+	assert.Equal(t, &FilterError{Query: "//*[count(.)]", Kind: RuntimeError, Msg: "Unable to register function count"}, err)
+}
+
+func TestPoolStats(t *testing.T) {
+	// the strings of the iterators not disposed by other tests are counted too
+	baseCount, baseBytes := PoolStats()
+
+	n := nodeTree()
+	n.Children[0].Token = "abc"
+
+	q, err := Prepare("//*[stats(@token)][@token=$token]")
+	assert.Nil(t, err)
+	defer q.Close()
+
+	var count, bytes int
+	assert.Nil(t, q.RegisterFunction("stats", func([]interface{}) (interface{}, error) {
+		count, bytes = PoolStats()
+		return true, nil
+	}))
+
+	r, err := q.FilterWithVars(n, map[string]string{"token": "abc"})
+	assert.Nil(t, err)
+	assert.Len(t, r, 1)
+
+	// the variable name and value, the function name and the internal types and
+	// tokens of the 5 nodes, with an empty token for the ones without one
+	strs := []string{"token", "abc", "stats"}
+	walkPreOrder(n, func(n *uast.Node) {
+		strs = append(strs, n.InternalType, n.Token)
+	})
+	size := 0
+	for _, s := range strs {
+		// every C string has a terminating NUL byte
+		size += len(s) + 1
+	}
+	assert.Equal(t, 13, len(strs))
+	assert.Equal(t, len(strs), count-baseCount)
+	assert.Equal(t, size, bytes-baseBytes)
+
+	count, bytes = PoolStats()
+	assert.Equal(t, baseCount, count)
+	assert.Equal(t, baseBytes, bytes)
+}
+
+func TestResetPool(t *testing.T) {
+	n := benchmarkTree()
+	r, err := Filter(n, "//*[@token='x']")
+	assert.Nil(t, err)
+	assert.Len(t, r, 0)
+	assert.NotEqual(t, 0, cap(defaultContext.table.pool.pointers))
+
+	count, bytes := PoolStats()
+	ResetPool()
+	assert.Equal(t, 0, cap(defaultContext.table.pool.pointers))
+	assert.Equal(t, 0, cap(defaultContext.table.nodes))
+	c, b := PoolStats()
+	assert.Equal(t, count, c)
+	assert.Equal(t, bytes, b)
+
+	// a running query is not reset
+	defaultContext.mu.Lock()
+	defaultContext.table.nodes = make([]*uast.Node, 0, 10)
+	ResetPool()
+	assert.Equal(t, 10, cap(defaultContext.table.nodes))
+	defaultContext.mu.Unlock()
+
+	r, err = Filter(n, "//File")
+	assert.Nil(t, err)
+	assert.Len(t, r, 1)
+}
+
+func benchmarkTree() *uast.Node {
+	root := &uast.Node{InternalType: "File"}
+	for i := 0; i < 100; i++ {
+		fn := &uast.Node{InternalType: "FunctionDef", Roles: []uast.Role{uast.Function, uast.Declaration}}
+		for j := 0; j < 10; j++ {
+			fn.Children = append(fn.Children, &uast.Node{
+				InternalType: "Name",
+				Token:        fmt.Sprintf("name%d", j),
+				Roles:        []uast.Role{uast.Identifier},
+			})
+		}
+		root.Children = append(root.Children, fn)
+	}
+	return root
+}
+
+const benchmarkQuery = "//FunctionDef[@roleFunction and @roleDeclaration]/Name[@roleIdentifier][@token='name1' or @token='name2']"
+
+func BenchmarkFilter(b *testing.B) {
+	root := benchmarkTree()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Filter(root, benchmarkQuery); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFilterInto(b *testing.B) {
+	root := benchmarkTree()
+	var buf []*uast.Node
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = FilterInto(root, "//Name", buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFilter_NoBuffer(b *testing.B) {
+	root := benchmarkTree()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Filter(root, "//Name"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPreparedQuery_Filter(b *testing.B) {
+	root := benchmarkTree()
+	q, err := Prepare(benchmarkQuery)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer q.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := q.Filter(root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
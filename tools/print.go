@@ -0,0 +1,168 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// MaxDOTTokenLength is the maximum number of characters of a token written in
+// a DOT node label, longer tokens are truncated.
+const MaxDOTTokenLength = 32
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+
+func dotLabel(n *uast.Node) string {
+	label := dotEscaper.Replace(n.InternalType)
+	if n.Token != "" {
+		token := n.Token
+		if r := []rune(token); len(r) > MaxDOTTokenLength {
+			token = string(r[:MaxDOTTokenLength]) + "..."
+		}
+		label += `\n\"` + dotEscaper.Replace(token) + `\"`
+	}
+	return label
+}
+
+// ToDOT writes a Graphviz DOT representation of the tree rooted at node to w.
+// Every node is labeled with its internal type and its token, if any, and is
+// linked to its children by edges in the children order, skipping the nil
+// ones.
+func ToDOT(node *uast.Node, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph uast {")
+	fmt.Fprintln(bw, "  node [shape=box];")
+
+	if node != nil {
+		type entry struct {
+			node *uast.Node
+			id   int
+		}
+
+		next := 0
+		stack := []entry{{node, next}}
+		for len(stack) > 0 {
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			fmt.Fprintf(bw, "  n%d [label=\"%s\"];\n", e.id, dotLabel(e.node))
+
+			nodes := nonNilChildren(e.node)
+			children := make([]entry, len(nodes))
+			for i, child := range nodes {
+				next++
+				children[i] = entry{child, next}
+				fmt.Fprintf(bw, "  n%d -> n%d;\n", e.id, next)
+			}
+
+			for i := len(children) - 1; i >= 0; i-- {
+				stack = append(stack, children[i])
+			}
+		}
+	}
+
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// PrettyOptions are the node fields written by PrettyWithOptions besides the
+// internal type, the token and the roles, which are always written.
+type PrettyOptions struct {
+	// Positions writes the start and end positions of the nodes, as
+	// `@line:col-line:col`.
+	Positions bool
+	// Properties writes the properties of the nodes, sorted by key, as
+	// `{key=value, ...}`.
+	Properties bool
+}
+
+// Pretty returns a readable dump of the tree rooted at node, one line per node
+// indented by its depth, with all the fields written by PrettyWithOptions:
+//
+//	Module [File, Module]
+//	└ Name "foo" [Identifier] @1:1-1:4 {ctx=Load}
+func Pretty(node *uast.Node) string {
+	return PrettyWithOptions(node, PrettyOptions{Positions: true, Properties: true})
+}
+
+// PrettyWithOptions is like Pretty but only the fields enabled in `opts` are
+// written.
+func PrettyWithOptions(node *uast.Node, opts PrettyOptions) string {
+	if node == nil {
+		return ""
+	}
+
+	type entry struct {
+		node  *uast.Node
+		depth int
+	}
+
+	var buf bytes.Buffer
+	stack := []entry{{node, 0}}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if e.depth > 0 {
+			buf.WriteString(strings.Repeat("  ", e.depth-1))
+			buf.WriteString("└ ")
+		}
+		writePrettyNode(&buf, e.node, opts)
+		buf.WriteByte('\n')
+
+		for i := len(e.node.Children) - 1; i >= 0; i-- {
+			if child := e.node.Children[i]; child != nil {
+				stack = append(stack, entry{child, e.depth + 1})
+			}
+		}
+	}
+	return buf.String()
+}
+
+func writePrettyNode(buf *bytes.Buffer, n *uast.Node, opts PrettyOptions) {
+	buf.WriteString(n.InternalType)
+	if n.Token != "" {
+		buf.WriteString(" " + strconv.Quote(n.Token))
+	}
+
+	if len(n.Roles) > 0 {
+		names := make([]string, len(n.Roles))
+		for i, r := range n.Roles {
+			names[i] = r.String()
+		}
+		buf.WriteString(" [" + strings.Join(names, ", ") + "]")
+	}
+
+	if opts.Positions && (n.StartPosition != nil || n.EndPosition != nil) {
+		buf.WriteString(" @" + prettyPosition(n.StartPosition))
+		if n.EndPosition != nil {
+			buf.WriteString("-" + prettyPosition(n.EndPosition))
+		}
+	}
+
+	if opts.Properties && len(n.Properties) > 0 {
+		keys := make([]string, 0, len(n.Properties))
+		for k := range n.Properties {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		props := make([]string, len(keys))
+		for i, k := range keys {
+			props[i] = k + "=" + n.Properties[k]
+		}
+		buf.WriteString(" {" + strings.Join(props, ", ") + "}")
+	}
+}
+
+func prettyPosition(p *uast.Position) string {
+	if p == nil {
+		return "?"
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
@@ -0,0 +1,82 @@
+package tools
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+func TestToDOT(t *testing.T) {
+	n := &uast.Node{
+		InternalType: "root",
+		Children: []*uast.Node{
+			{InternalType: "a", Token: `say "hi"`},
+			{InternalType: "b", Token: strings.Repeat("x", 40)},
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, ToDOT(n, &buf))
+	assert.Equal(t, `digraph uast {
+  node [shape=box];
+  n0 [label="root"];
+  n0 -> n1;
+  n0 -> n2;
+  n1 [label="a\n\"say \"hi\"\""];
+  n2 [label="b\n\"`+strings.Repeat("x", 32)+`...\""];
+}
+`, buf.String())
+
+	// the nil children are skipped
+	n.Children = []*uast.Node{nil, n.Children[0], nil}
+	buf.Reset()
+	assert.Nil(t, ToDOT(n, &buf))
+	assert.Equal(t, `digraph uast {
+  node [shape=box];
+  n0 [label="root"];
+  n0 -> n1;
+  n1 [label="a\n\"say \"hi\"\""];
+}
+`, buf.String())
+
+	withoutNil := &uast.Node{InternalType: "root", Children: n.Children[1:2]}
+	assert.Equal(t, Pretty(withoutNil), Pretty(n))
+}
+
+func TestPretty(t *testing.T) {
+	n := &uast.Node{
+		InternalType: "Module",
+		Roles:        []uast.Role{uast.File, uast.Module},
+		Children: []*uast.Node{
+			{
+				InternalType:  "Name",
+				Token:         "foo",
+				Roles:         []uast.Role{uast.Identifier},
+				Properties:    map[string]string{"ctx": "Load", "a": "b"},
+				StartPosition: &uast.Position{Offset: 0, Line: 1, Col: 1},
+				EndPosition:   &uast.Position{Offset: 3, Line: 1, Col: 4},
+				Children: []*uast.Node{
+					{InternalType: "Leaf", EndPosition: &uast.Position{Line: 2, Col: 3}},
+				},
+			},
+			{InternalType: "Str", Token: "a\nb", StartPosition: &uast.Position{Line: 3, Col: 1}},
+		},
+	}
+
+	assert.Equal(t, `Module [File, Module]
+└ Name "foo" [Identifier] @1:1-1:4 {a=b, ctx=Load}
+  └ Leaf @?-2:3
+└ Str "a\nb" @3:1
+`, Pretty(n))
+
+	assert.Equal(t, `Module [File, Module]
+└ Name "foo" [Identifier]
+  └ Leaf
+└ Str "a\nb"
+`, PrettyWithOptions(n, PrettyOptions{}))
+
+	assert.Equal(t, "", Pretty(nil))
+}
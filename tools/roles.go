@@ -0,0 +1,53 @@
+package tools
+
+import (
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// MatchingRoles returns the subset of `roles` that `node` has, in the same
+// order as they are given.
+func MatchingRoles(node *uast.Node, roles []uast.Role) []uast.Role {
+	if node == nil || len(node.Roles) == 0 {
+		return nil
+	}
+
+	has := make(map[uast.Role]bool, len(node.Roles))
+	for _, r := range node.Roles {
+		has[r] = true
+	}
+
+	var matching []uast.Role
+	for _, r := range roles {
+		if has[r] {
+			matching = append(matching, r)
+		}
+	}
+	return matching
+}
+
+var roleNames map[string]uast.Role
+
+func init() {
+	roleNames = make(map[string]uast.Role, len(uast.Role_name))
+	for id := range uast.Role_name {
+		r := uast.Role(id)
+		roleNames[r.String()] = r
+	}
+}
+
+// RoleByName returns the role with the given name, as returned by
+// RoleName, like "Identifier" or "Call". The returned bool is false if there is
+// no role with that name.
+func RoleByName(name string) (uast.Role, bool) {
+	r, ok := roleNames[name]
+	return r, ok
+}
+
+// RoleName returns the name of the role, like "Identifier" for uast.Identifier,
+// or "" if the role is not known by the SDK.
+func RoleName(r uast.Role) string {
+	if _, ok := uast.Role_name[int32(r)]; !ok {
+		return ""
+	}
+	return r.String()
+}
@@ -0,0 +1,43 @@
+package tools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+func TestMatchingRoles(t *testing.T) {
+	n := &uast.Node{Roles: []uast.Role{uast.Identifier, uast.Expression, uast.Call}}
+
+	r := MatchingRoles(n, []uast.Role{uast.Call, uast.Statement, uast.Identifier})
+	assert.Equal(t, []uast.Role{uast.Call, uast.Identifier}, r)
+
+	assert.Len(t, MatchingRoles(n, []uast.Role{uast.Statement}), 0)
+	assert.Len(t, MatchingRoles(&uast.Node{}, []uast.Role{uast.Call}), 0)
+	assert.Len(t, MatchingRoles(nil, []uast.Role{uast.Call}), 0)
+}
+
+func TestRoleByName(t *testing.T) {
+	assert.NotEmpty(t, uast.Role_name)
+	for id := range uast.Role_name {
+		r := uast.Role(id)
+		name := RoleName(r)
+		assert.NotEqual(t, "", name)
+
+		found, ok := RoleByName(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, r, found)
+	}
+
+	r, ok := RoleByName("Identifier")
+	assert.True(t, ok)
+	assert.Equal(t, uast.Identifier, r)
+	assert.Equal(t, "Call", RoleName(uast.Call))
+
+	_, ok = RoleByName("NotARole")
+	assert.False(t, ok)
+	_, ok = RoleByName("identifier")
+	assert.False(t, ok)
+	assert.Equal(t, "", RoleName(uast.Role(-1)))
+}
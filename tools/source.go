@@ -0,0 +1,335 @@
+package tools
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// SourceSnippet returns the code the node covers in source, the bytes in
+// [StartPosition.Offset, EndPosition.Offset), or false if the node lacks any
+// of both positions or the offsets are out of the source.
+func SourceSnippet(source []byte, node *uast.Node) (string, bool) {
+	if node == nil || node.StartPosition == nil || node.EndPosition == nil {
+		return "", false
+	}
+
+	start, end := node.StartPosition.Offset, node.EndPosition.Offset
+	if start > end || int64(end) > int64(len(source)) {
+		return "", false
+	}
+	return string(source[start:end]), true
+}
+
+// hasOffset reports whether the offset of a position is set: a zero offset is
+// taken as missing if the line or column say it is not the start of the file.
+func hasOffset(p *uast.Position) bool {
+	return p.Offset != 0 || (p.Line <= 1 && p.Col <= 1)
+}
+
+// comparePositions returns -1, 0 or 1 if a is before, at or after b. Offsets
+// are compared if both positions have them, and lines and columns otherwise.
+func comparePositions(a, b *uast.Position) int {
+	ka, kb := [2]uint32{a.Offset}, [2]uint32{b.Offset}
+	if !hasOffset(a) || !hasOffset(b) {
+		ka, kb = [2]uint32{a.Line, a.Col}, [2]uint32{b.Line, b.Col}
+	}
+
+	for i := range ka {
+		if ka[i] < kb[i] {
+			return -1
+		} else if ka[i] > kb[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// PositionBefore reports whether the position a is strictly before b. The
+// offsets are compared, or the lines and columns if any of the offsets is
+// missing, which is a zero offset with a line or column after the first one.
+// It is false if any of the positions is nil.
+func PositionBefore(a, b *uast.Position) bool {
+	return a != nil && b != nil && comparePositions(a, b) < 0
+}
+
+// PositionContains reports whether the position p is between the start and
+// end positions of the node, both included. It is false if p is nil or the
+// node lacks any of both positions.
+func PositionContains(outer *uast.Node, p *uast.Position) bool {
+	if outer == nil || outer.StartPosition == nil || outer.EndPosition == nil || p == nil {
+		return false
+	}
+	return comparePositions(outer.StartPosition, p) <= 0 && comparePositions(p, outer.EndPosition) <= 0
+}
+
+// NodeContains reports whether the span of the inner node is within the one
+// of the outer node, both ends included, so a node contains itself. It is
+// false if any of the nodes lacks any of both positions, even if inner is a
+// descendant of outer.
+func NodeContains(outer, inner *uast.Node) bool {
+	if inner == nil || inner.StartPosition == nil || inner.EndPosition == nil {
+		return false
+	}
+	return PositionContains(outer, inner.StartPosition) && PositionContains(outer, inner.EndPosition)
+}
+
+// SortByPosition sorts the nodes in place by the start position, as compared
+// by PositionBefore. The sort is stable: the nodes starting at the same
+// position keep their relative order, so for the results of a query a parent
+// comes before its children starting with it. The nodes without a start
+// position, and the nil ones, are moved to the end, also keeping their relative
+// order.
+func SortByPosition(nodes []*uast.Node) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if a == nil || a.StartPosition == nil {
+			return false
+		}
+		if b == nil || b.StartPosition == nil {
+			return true
+		}
+		return comparePositions(a.StartPosition, b.StartPosition) < 0
+	})
+}
+
+// NodesInOffsetRange returns the nodes of the tree whose offsets span
+// [StartPosition.Offset, EndPosition.Offset] intersects [start, end], both
+// ends included. The nodes lacking any of both positions are skipped, but not
+// their children. The nodes are sorted by descending span size, with the ties
+// kept in pre-order, so the last one is the tightest node covering the range.
+func NodesInOffsetRange(root *uast.Node, start, end uint32) []*uast.Node {
+	if start > end {
+		return nil
+	}
+
+	var nodes []*uast.Node
+	walkPreOrder(root, func(n *uast.Node) {
+		if n.StartPosition == nil || n.EndPosition == nil {
+			return
+		}
+
+		if n.StartPosition.Offset <= end && start <= n.EndPosition.Offset {
+			nodes = append(nodes, n)
+		}
+	})
+
+	span := func(n *uast.Node) int64 {
+		return int64(n.EndPosition.Offset) - int64(n.StartPosition.Offset)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return span(nodes[i]) > span(nodes[j])
+	})
+	return nodes
+}
+
+// NodesAtLine returns, in pre-order, the nodes of the tree whose start
+// position is on the given 1-based line. The nodes without a start position
+// are skipped, but not their children.
+func NodesAtLine(root *uast.Node, line uint32) []*uast.Node {
+	var nodes []*uast.Node
+	walkPreOrder(root, func(n *uast.Node) {
+		if n.StartPosition != nil && n.StartPosition.Line == line {
+			nodes = append(nodes, n)
+		}
+	})
+	return nodes
+}
+
+// Range is the span of a node in lines and columns, both 1-based, from its
+// start position to its end position.
+type Range struct {
+	StartLine, StartCol, EndLine, EndCol uint32
+}
+
+// RangedNode is a node together with its Range.
+type RangedNode struct {
+	Node  *uast.Node
+	Range Range
+}
+
+// NodesInLineRange returns, in pre-order, the nodes of the tree that are
+// within the lines [startLine, endLine], both ends included: those starting at
+// startLine or later and ending at endLine or before, with their ranges. The
+// nodes lacking any of both positions, or their line, are skipped, but not
+// their children.
+func NodesInLineRange(root *uast.Node, startLine, endLine uint32) []RangedNode {
+	if startLine > endLine {
+		return nil
+	}
+
+	var nodes []RangedNode
+	walkPreOrder(root, func(n *uast.Node) {
+		start, end := n.StartPosition, n.EndPosition
+		if start == nil || end == nil || start.Line == 0 || end.Line == 0 {
+			return
+		}
+
+		if startLine <= start.Line && end.Line <= endLine {
+			nodes = append(nodes, RangedNode{
+				Node: n,
+				Range: Range{
+					StartLine: start.Line,
+					StartCol:  start.Col,
+					EndLine:   end.Line,
+					EndCol:    end.Col,
+				},
+			})
+		}
+	})
+	return nodes
+}
+
+// LineIndex holds the offsets where every line of a source starts, to compute
+// the line and column of offsets in O(log n) for n lines.
+type LineIndex struct {
+	starts []uint32
+	size   uint32
+}
+
+// NewLineIndex returns the LineIndex of the source, whose lines are ended by
+// '\n'.
+func NewLineIndex(source []byte) *LineIndex {
+	idx := &LineIndex{starts: []uint32{0}, size: uint32(len(source))}
+	for i, c := range source {
+		if c == '\n' {
+			idx.starts = append(idx.starts, uint32(i+1))
+		}
+	}
+	return idx
+}
+
+// LineCol returns the 1-based line and column of the offset, where the column
+// counts bytes, not characters. An offset past the end of the source is on
+// the last line, past its end.
+func (idx *LineIndex) LineCol(offset uint32) (line, col uint32) {
+	line = uint32(sort.Search(len(idx.starts), func(i int) bool {
+		return idx.starts[i] > offset
+	}))
+	return line, offset - idx.starts[line-1] + 1
+}
+
+// PositionError describes a node position whose line and column do not
+// match its offset in the source.
+type PositionError struct {
+	// Node is the node with the wrong position.
+	Node *uast.Node
+	// Path are the indexes of the children to follow from the root to Node.
+	Path []int
+	// End is true if the wrong position is the end one.
+	End bool
+	// Position is the wrong position.
+	Position uast.Position
+	// Expected is the position computed from its offset, or nil if the offset
+	// is out of the source range.
+	Expected *uast.Position
+}
+
+func (e PositionError) Error() string {
+	path := make([]string, len(e.Path))
+	for i, idx := range e.Path {
+		path[i] = strconv.Itoa(idx)
+	}
+
+	kind := "start"
+	if e.End {
+		kind = "end"
+	}
+
+	if e.Expected == nil {
+		return fmt.Sprintf("/%s: %s offset %d out of range",
+			strings.Join(path, "/"), kind, e.Position.Offset)
+	}
+
+	return fmt.Sprintf("/%s: %s offset %d is at %d:%d, not %d:%d",
+		strings.Join(path, "/"), kind, e.Position.Offset,
+		e.Expected.Line, e.Expected.Col, e.Position.Line, e.Position.Col)
+}
+
+// ValidatePositions checks that the line and column of every start and end
+// position in the tree match exactly the ones computed from its offset in
+// `source`, and that the offset is within the source. It returns a
+// PositionError, in pre-order, for every position that does not. Positions
+// with both line and column set to 0 only have their offset checked, since
+// some drivers do not fill them.
+func ValidatePositions(node *uast.Node, source []byte) []PositionError {
+	if node == nil {
+		return nil
+	}
+
+	idx := NewLineIndex(source)
+	check := func(n *uast.Node, path []int, p *uast.Position, end bool) *PositionError {
+		if p == nil {
+			return nil
+		}
+
+		perr := &PositionError{Node: n, Path: path, End: end, Position: *p}
+		if p.Offset > idx.size {
+			return perr
+		}
+
+		if p.Line == 0 && p.Col == 0 {
+			return nil
+		}
+
+		line, col := idx.LineCol(p.Offset)
+		if line == p.Line && col == p.Col {
+			return nil
+		}
+
+		perr.Expected = &uast.Position{Offset: p.Offset, Line: line, Col: col}
+		return perr
+	}
+
+	type entry struct {
+		node *uast.Node
+		path []int
+	}
+
+	var errs []PositionError
+	stack := []entry{{node, nil}}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if perr := check(e.node, e.path, e.node.StartPosition, false); perr != nil {
+			errs = append(errs, *perr)
+		}
+		if perr := check(e.node, e.path, e.node.EndPosition, true); perr != nil {
+			errs = append(errs, *perr)
+		}
+
+		for i := len(e.node.Children) - 1; i >= 0; i-- {
+			if e.node.Children[i] == nil {
+				continue
+			}
+
+			path := make([]int, len(e.path)+1)
+			copy(path, e.path)
+			path[len(e.path)] = i
+			stack = append(stack, entry{e.node.Children[i], path})
+		}
+	}
+	return errs
+}
+
+// FillPositions sets the line and column of every start and end position of
+// the tree that has none, which is both of them set to 0, from its offset. The
+// positions whose offset is past the end of the source of the index are left
+// unchanged, as well as the ones with a line or a column.
+func FillPositions(root *uast.Node, idx *LineIndex) {
+	fill := func(p *uast.Position) {
+		if p == nil || p.Line != 0 || p.Col != 0 || p.Offset > idx.size {
+			return
+		}
+		p.Line, p.Col = idx.LineCol(p.Offset)
+	}
+
+	walkPreOrder(root, func(n *uast.Node) {
+		fill(n.StartPosition)
+		fill(n.EndPosition)
+	})
+}
@@ -0,0 +1,281 @@
+package tools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+func TestValidatePositions(t *testing.T) {
+	source := []byte("foo\nbar = 1\n")
+	bad := &uast.Node{
+		StartPosition: &uast.Position{Offset: 4, Line: 2, Col: 2},
+		EndPosition:   &uast.Position{Offset: 20, Line: 3, Col: 1},
+	}
+	n := &uast.Node{
+		StartPosition: &uast.Position{Offset: 0, Line: 1, Col: 1},
+		EndPosition:   &uast.Position{Offset: 12, Line: 3, Col: 1},
+		Children: []*uast.Node{{
+			StartPosition: &uast.Position{Offset: 10, Line: 2, Col: 7},
+			EndPosition:   &uast.Position{Offset: 11},
+		}, bad},
+	}
+
+	errs := ValidatePositions(n, source)
+	assert.Len(t, errs, 2)
+
+	assert.Equal(t, bad, errs[0].Node)
+	assert.Equal(t, []int{1}, errs[0].Path)
+	assert.False(t, errs[0].End)
+	assert.Equal(t, &uast.Position{Offset: 4, Line: 2, Col: 1}, errs[0].Expected)
+	assert.Equal(t, "/1: start offset 4 is at 2:1, not 2:2", errs[0].Error())
+
+	assert.True(t, errs[1].End)
+	assert.Nil(t, errs[1].Expected)
+	assert.Equal(t, "/1: end offset 20 out of range", errs[1].Error())
+
+	assert.Len(t, ValidatePositions(nil, source), 0)
+}
+
+func TestNodesInOffsetRange(t *testing.T) {
+	pos := func(start, end uint32) (*uast.Position, *uast.Position) {
+		return &uast.Position{Offset: start}, &uast.Position{Offset: end}
+	}
+
+	n := &uast.Node{InternalType: "root"}
+	n.StartPosition, n.EndPosition = pos(0, 100)
+	a := &uast.Node{InternalType: "a"}
+	a.StartPosition, a.EndPosition = pos(10, 50)
+	b := &uast.Node{InternalType: "b"}
+	b.StartPosition, b.EndPosition = pos(20, 30)
+	c := &uast.Node{InternalType: "c"}
+	c.StartPosition, c.EndPosition = pos(60, 90)
+	noPos := &uast.Node{InternalType: "noPos", Children: []*uast.Node{b}}
+	a.Children = []*uast.Node{noPos}
+	n.Children = []*uast.Node{a, c}
+
+	assert.Equal(t, []*uast.Node{n, a, b}, NodesInOffsetRange(n, 25, 28))
+	assert.Equal(t, []*uast.Node{n, a, c, b}, NodesInOffsetRange(n, 30, 60))
+	assert.Equal(t, []*uast.Node{n, a}, NodesInOffsetRange(n, 50, 50))
+	assert.Equal(t, []*uast.Node{n}, NodesInOffsetRange(n, 95, 200))
+	assert.Len(t, NodesInOffsetRange(n, 101, 200), 0)
+	assert.Len(t, NodesInOffsetRange(n, 30, 20), 0)
+	assert.Len(t, NodesInOffsetRange(nil, 0, 10), 0)
+}
+
+func TestPositionBefore(t *testing.T) {
+	p := func(offset, line, col uint32) *uast.Position {
+		return &uast.Position{Offset: offset, Line: line, Col: col}
+	}
+
+	assert.True(t, PositionBefore(p(1, 1, 2), p(5, 1, 6)))
+	assert.False(t, PositionBefore(p(5, 1, 6), p(1, 1, 2)))
+	assert.False(t, PositionBefore(p(5, 1, 6), p(5, 1, 6)))
+	assert.True(t, PositionBefore(p(0, 1, 1), p(5, 1, 6)))
+
+	// without offsets, lines and columns are compared
+	assert.True(t, PositionBefore(p(0, 2, 3), p(0, 2, 4)))
+	assert.True(t, PositionBefore(p(0, 2, 9), p(0, 3, 1)))
+	assert.False(t, PositionBefore(p(0, 3, 1), p(0, 2, 9)))
+	assert.True(t, PositionBefore(p(30, 2, 1), p(0, 3, 1)))
+
+	assert.False(t, PositionBefore(nil, p(1, 1, 2)))
+	assert.False(t, PositionBefore(p(1, 1, 2), nil))
+}
+
+func TestNodeContains(t *testing.T) {
+	outer := &uast.Node{
+		StartPosition: &uast.Position{Offset: 10, Line: 2, Col: 1},
+		EndPosition:   &uast.Position{Offset: 50, Line: 4, Col: 5},
+	}
+	inner := &uast.Node{
+		StartPosition: &uast.Position{Offset: 10, Line: 2, Col: 1},
+		EndPosition:   &uast.Position{Offset: 20, Line: 2, Col: 11},
+	}
+	after := &uast.Node{
+		StartPosition: &uast.Position{Offset: 40, Line: 4, Col: 1},
+		EndPosition:   &uast.Position{Offset: 60, Line: 5, Col: 2},
+	}
+
+	assert.True(t, PositionContains(outer, &uast.Position{Offset: 10}))
+	assert.True(t, PositionContains(outer, &uast.Position{Offset: 50}))
+	assert.False(t, PositionContains(outer, &uast.Position{Offset: 51}))
+	assert.True(t, PositionContains(outer, &uast.Position{Line: 3, Col: 20}))
+	assert.False(t, PositionContains(outer, &uast.Position{Line: 4, Col: 6}))
+	assert.False(t, PositionContains(outer, nil))
+	assert.False(t, PositionContains(&uast.Node{}, &uast.Position{Offset: 10}))
+
+	assert.True(t, NodeContains(outer, inner))
+	assert.True(t, NodeContains(outer, outer))
+	assert.False(t, NodeContains(inner, outer))
+	assert.False(t, NodeContains(outer, after))
+	assert.False(t, NodeContains(outer, &uast.Node{}))
+	assert.False(t, NodeContains(nil, inner))
+}
+
+func TestSourceSnippet(t *testing.T) {
+	source := []byte("x = foo(1)")
+	span := func(start, end uint32) *uast.Node {
+		return &uast.Node{
+			StartPosition: &uast.Position{Offset: start},
+			EndPosition:   &uast.Position{Offset: end},
+		}
+	}
+
+	cases := []struct {
+		node *uast.Node
+		text string
+		ok   bool
+	}{
+		{span(4, 10), "foo(1)", true},
+		{span(0, 1), "x", true},
+		{span(3, 3), "", true},
+		{span(4, 11), "", false},
+		{span(12, 20), "", false},
+		{span(5, 4), "", false},
+		{&uast.Node{StartPosition: &uast.Position{Offset: 1}}, "", false},
+		{&uast.Node{}, "", false},
+		{nil, "", false},
+	}
+
+	for i, c := range cases {
+		text, ok := SourceSnippet(source, c.node)
+		assert.Equal(t, c.ok, ok, "case %d", i)
+		assert.Equal(t, c.text, text, "case %d", i)
+	}
+}
+
+func TestSortByPosition(t *testing.T) {
+	at := func(typ string, offset uint32, children ...*uast.Node) *uast.Node {
+		return &uast.Node{
+			InternalType:  typ,
+			StartPosition: &uast.Position{Offset: offset, Line: 1, Col: offset + 1},
+			Children:      children,
+		}
+	}
+
+	// the operands of the assignment come before its node in the source
+	left, right := at("left", 0), at("right", 4)
+	assign := at("assign", 2, left, right)
+	noPos := &uast.Node{InternalType: "noPos"}
+	call := at("call", 6, at("name", 6), noPos)
+	root := at("root", 0, assign, call)
+
+	nodes := []*uast.Node{root, assign, left, right, call, call.Children[0], noPos}
+	sorted := append([]*uast.Node{nil}, nodes...)
+	SortByPosition(sorted)
+	assert.Equal(t, []*uast.Node{root, left, assign, right, call, call.Children[0], nil, noPos}, sorted)
+
+	r, err := Filter(root, "//*")
+	assert.Nil(t, err)
+	assert.Equal(t, nodes, r, "document order")
+
+	r, err = FilterSorted(root, "//*")
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{root, left, assign, right, call, call.Children[0], noPos}, r)
+
+	_, err = FilterSorted(root, "//*[")
+	assert.IsType(t, &FilterError{}, err)
+}
+
+func TestNodesAtLine(t *testing.T) {
+	at := func(typ string, start, end uint32, children ...*uast.Node) *uast.Node {
+		return &uast.Node{
+			InternalType:  typ,
+			StartPosition: &uast.Position{Line: start, Col: 1},
+			EndPosition:   &uast.Position{Line: end, Col: 1},
+			Children:      children,
+		}
+	}
+
+	call := at("call", 3, 3, at("name", 3, 3))
+	ret := at("return", 4, 4)
+	body := at("body", 2, 5, call, ret)
+	noPos := &uast.Node{InternalType: "noPos", Children: []*uast.Node{at("arg", 3, 3)}}
+	fn := at("func", 1, 6, at("name", 1, 1), body, noPos)
+
+	assert.Equal(t, []*uast.Node{fn, fn.Children[0]}, NodesAtLine(fn, 1))
+	assert.Equal(t, []*uast.Node{body}, NodesAtLine(fn, 2))
+	assert.Equal(t, []*uast.Node{call, call.Children[0], noPos.Children[0]}, NodesAtLine(fn, 3))
+	assert.Len(t, NodesAtLine(fn, 5), 0)
+	assert.Len(t, NodesAtLine(nil, 1), 0)
+}
+
+func TestNodesInLineRange(t *testing.T) {
+	at := func(typ string, start, end uint32, children ...*uast.Node) *uast.Node {
+		return &uast.Node{
+			InternalType:  typ,
+			StartPosition: &uast.Position{Line: start, Col: 2},
+			EndPosition:   &uast.Position{Line: end, Col: 8},
+			Children:      children,
+		}
+	}
+
+	call := at("call", 3, 3, at("name", 3, 3))
+	ret := at("return", 4, 5)
+	body := at("body", 2, 5, call, ret)
+	noPos := &uast.Node{InternalType: "noPos", Children: []*uast.Node{at("arg", 4, 4)}}
+	fn := at("func", 1, 6, at("name", 1, 1), body, noPos)
+
+	types := func(nodes []RangedNode) []string {
+		var types []string
+		for _, n := range nodes {
+			types = append(types, n.Node.InternalType)
+		}
+		return types
+	}
+
+	r := NodesInLineRange(fn, 3, 4)
+	assert.Equal(t, []string{"call", "name", "arg"}, types(r))
+	assert.Equal(t, Range{StartLine: 3, StartCol: 2, EndLine: 3, EndCol: 8}, r[0].Range)
+	assert.Equal(t, []string{"body", "call", "name", "return", "arg"}, types(NodesInLineRange(fn, 2, 5)))
+	assert.Len(t, NodesInLineRange(fn, 1, 6), 7)
+	assert.Len(t, NodesInLineRange(fn, 7, 9), 0)
+	assert.Len(t, NodesInLineRange(fn, 4, 3), 0)
+	assert.Len(t, NodesInLineRange(nil, 1, 6), 0)
+}
+
+func TestLineIndex(t *testing.T) {
+	idx := NewLineIndex([]byte("foo\nbar = 1\n\nx"))
+
+	cases := []struct {
+		offset, line, col uint32
+	}{
+		{0, 1, 1}, {2, 1, 3}, {3, 1, 4}, {4, 2, 1}, {10, 2, 7},
+		{12, 3, 1}, {13, 4, 1}, {14, 4, 2}, {20, 4, 8},
+	}
+	for _, c := range cases {
+		line, col := idx.LineCol(c.offset)
+		assert.Equal(t, [2]uint32{c.line, c.col}, [2]uint32{line, col}, "offset %d", c.offset)
+	}
+
+	line, col := NewLineIndex(nil).LineCol(0)
+	assert.Equal(t, [2]uint32{1, 1}, [2]uint32{line, col})
+}
+
+func TestFillPositions(t *testing.T) {
+	source := []byte("foo\nbar = 1\n")
+	child := &uast.Node{
+		StartPosition: &uast.Position{Offset: 10},
+		EndPosition:   &uast.Position{Offset: 11},
+	}
+	n := &uast.Node{
+		StartPosition: &uast.Position{Offset: 0},
+		EndPosition:   &uast.Position{Offset: 12, Line: 9, Col: 9},
+		Children: []*uast.Node{child, {
+			StartPosition: &uast.Position{Offset: 40},
+		}, {}},
+	}
+
+	FillPositions(n, NewLineIndex(source))
+	assert.Equal(t, &uast.Position{Offset: 0, Line: 1, Col: 1}, n.StartPosition)
+	assert.Equal(t, &uast.Position{Offset: 12, Line: 9, Col: 9}, n.EndPosition)
+	assert.Equal(t, &uast.Position{Offset: 10, Line: 2, Col: 7}, child.StartPosition)
+	assert.Equal(t, &uast.Position{Offset: 11, Line: 2, Col: 8}, child.EndPosition)
+	assert.Equal(t, &uast.Position{Offset: 40}, n.Children[1].StartPosition)
+
+	errs := ValidatePositions(child, source)
+	assert.Len(t, errs, 0)
+	FillPositions(nil, NewLineIndex(source))
+}
@@ -0,0 +1,115 @@
+package tools
+
+import (
+	"runtime"
+	"sync"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// StreamResult is the outcome of filtering a tree submitted to a StreamFilter.
+type StreamResult struct {
+	// ID is the identifier the tree was submitted with.
+	ID string
+	// Nodes are the nodes matching the query.
+	Nodes []*uast.Node
+	// Err is the error found filtering the tree, if any.
+	Err error
+}
+
+// StreamFilter applies a fixed xpath query to a stream of trees, with a bounded
+// number of goroutines filtering the trees in parallel, each one with the query
+// compiled once for all its trees. Results are delivered on the Results channel
+// in the order they are completed, which is not necessarily the submission
+// order.
+type StreamFilter struct {
+	xpath   string
+	pending chan streamItem
+	results chan StreamResult
+	wg      sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+type streamItem struct {
+	id   string
+	node *uast.Node
+}
+
+// NewStreamFilter returns a StreamFilter running the xpath query over the
+// submitted trees with `workers` goroutines (runtime.NumCPU() if `workers` <= 0).
+// Up to `buffer` trees can be waiting to be filtered before Submit blocks.
+func NewStreamFilter(xpath string, workers, buffer int) *StreamFilter {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	if buffer < 0 {
+		buffer = 0
+	}
+
+	s := &StreamFilter{
+		xpath:   xpath,
+		pending: make(chan streamItem, buffer),
+		results: make(chan StreamResult, workers),
+	}
+
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go s.work()
+	}
+	return s
+}
+
+// work filters the pending trees with its own prepared query, which is freed
+// once Close stops the stream.
+func (s *StreamFilter) work() {
+	defer s.wg.Done()
+	q := newWorkerQuery(s.xpath)
+	defer q.close()
+	for item := range s.pending {
+		nodes, err := q.filter(item.node)
+		s.results <- StreamResult{ID: item.id, Nodes: nodes, Err: err}
+	}
+}
+
+// Submit queues the tree to be filtered. It blocks while the queue is full,
+// which only drains as long as the Results channel is consumed. It returns an
+// *ErrInvalidArgument error if the StreamFilter has been closed.
+func (s *StreamFilter) Submit(id string, node *uast.Node) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return &ErrInvalidArgument{Message: "submit on closed stream filter"}
+	}
+
+	s.pending <- streamItem{id: id, node: node}
+	return nil
+}
+
+// Results returns the channel where the results are delivered. It is closed
+// once the StreamFilter has been closed and all the submitted trees have been
+// filtered.
+func (s *StreamFilter) Results() <-chan StreamResult {
+	return s.results
+}
+
+// Close stops accepting new trees and waits until all the submitted ones have
+// been filtered, then closes the Results channel. The Results channel must be
+// drained concurrently, or Close will wait forever for the workers to deliver
+// their results. Calling Close more than once has no effect.
+func (s *StreamFilter) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.pending)
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	close(s.results)
+}
@@ -0,0 +1,66 @@
+package tools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamFilter(t *testing.T) {
+	s := NewStreamFilter("//child1", 2, 1)
+
+	done := make(chan map[string]int)
+	go func() {
+		counts := make(map[string]int)
+		for r := range s.Results() {
+			assert.Nil(t, r.Err)
+			counts[r.ID] = len(r.Nodes)
+		}
+		done <- counts
+	}()
+
+	for name, node := range corpus() {
+		assert.Nil(t, s.Submit(name, node))
+	}
+	s.Close()
+	s.Close()
+
+	assert.Equal(t, map[string]int{"a.py": 1, "b.py": 1, "c.py": 0}, <-done)
+	assert.NotNil(t, s.Submit("d.py", nodeTree()))
+}
+
+func TestStreamFilter_Parallel(t *testing.T) {
+	// the workers must not wait for the queries of the default context
+	defaultContext.mu.Lock()
+	defer defaultContext.mu.Unlock()
+
+	s := NewStreamFilter("//child1", 3, 0)
+	go func() {
+		for name, node := range corpus() {
+			assert.Nil(t, s.Submit(name, node))
+		}
+		s.Close()
+	}()
+
+	counts := make(map[string]int)
+	for r := range s.Results() {
+		assert.Nil(t, r.Err)
+		counts[r.ID] = len(r.Nodes)
+	}
+	assert.Equal(t, map[string]int{"a.py": 1, "b.py": 1, "c.py": 0}, counts)
+}
+
+func TestStreamFilter_InvalidQuery(t *testing.T) {
+	s := NewStreamFilter(":", 2, 3)
+	for name, node := range corpus() {
+		assert.Nil(t, s.Submit(name, node))
+	}
+	go s.Close()
+
+	count := 0
+	for r := range s.Results() {
+		assert.IsType(t, &FilterError{}, r.Err)
+		count++
+	}
+	assert.Equal(t, 3, count)
+}
@@ -0,0 +1,137 @@
+package tools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// ParseTestTree builds a tree from a compact text representation, meant to
+// write test fixtures. Every non-empty line describes a node with the
+// following space separated fields:
+//
+//	<internal type> ["<token>"] [<role> ...] [<key>=<value> ...]
+//
+// The token is a Go double quoted string, roles are given by their names (as
+// in `uast.Role.String()`) and properties are key=value pairs without spaces.
+// The children of a node are the lines that follow it with a deeper
+// indentation, which must be made of spaces. Lines starting with `#` are
+// ignored. There must be exactly one root node, e.g.:
+//
+//	Module
+//	  Import Import Statement
+//	    alias "foo" Identifier asname=bar
+func ParseTestTree(s string) (*uast.Node, error) {
+	type level struct {
+		indent int
+		node   *uast.Node
+	}
+
+	var (
+		root  *uast.Node
+		stack []level
+	)
+
+	for i, line := range strings.Split(s, "\n") {
+		content := strings.TrimLeft(line, " ")
+		if strings.TrimSpace(content) == "" || strings.HasPrefix(content, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: indentation must use spaces", i+1)
+		}
+
+		node, err := parseTestNode(content)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+
+		indent := len(line) - len(content)
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		if len(stack) == 0 {
+			if root != nil {
+				return nil, fmt.Errorf("line %d: more than one root node", i+1)
+			}
+			root = node
+		} else {
+			parent := stack[len(stack)-1].node
+			parent.Children = append(parent.Children, node)
+		}
+		stack = append(stack, level{indent, node})
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("empty tree")
+	}
+	return root, nil
+}
+
+func parseTestNode(line string) (*uast.Node, error) {
+	fields, err := splitTestFields(line)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &uast.Node{InternalType: fields[0]}
+	for _, f := range fields[1:] {
+		switch {
+		case strings.HasPrefix(f, `"`):
+			token, err := strconv.Unquote(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid token %s", f)
+			}
+			node.Token = token
+		case strings.Contains(f, "="):
+			kv := strings.SplitN(f, "=", 2)
+			if node.Properties == nil {
+				node.Properties = make(map[string]string)
+			}
+			node.Properties[kv[0]] = kv[1]
+		default:
+			role, ok := RoleByName(f)
+			if !ok {
+				return nil, fmt.Errorf("unknown role %s", f)
+			}
+			node.Roles = append(node.Roles, role)
+		}
+	}
+	return node, nil
+}
+
+// splitTestFields splits a line by spaces, keeping quoted strings together.
+func splitTestFields(line string) ([]string, error) {
+	var fields []string
+	for i := 0; i < len(line); {
+		if line[i] == ' ' {
+			i++
+			continue
+		}
+
+		start := i
+		if line[i] == '"' {
+			i++
+			for i < len(line) && line[i] != '"' {
+				if line[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated token")
+			}
+			i++
+		} else {
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+		}
+		fields = append(fields, line[start:i])
+	}
+	return fields, nil
+}
@@ -0,0 +1,47 @@
+package tools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+func TestParseTestTree(t *testing.T) {
+	n, err := ParseTestTree(`
+# a comment
+Module
+  Import Import Statement
+    alias "foo bar" Identifier asname=baz
+  Expr
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, &uast.Node{
+		InternalType: "Module",
+		Children: []*uast.Node{{
+			InternalType: "Import",
+			Roles:        []uast.Role{uast.Import, uast.Statement},
+			Children: []*uast.Node{{
+				InternalType: "alias",
+				Token:        "foo bar",
+				Roles:        []uast.Role{uast.Identifier},
+				Properties:   map[string]string{"asname": "baz"},
+			}},
+		}, {
+			InternalType: "Expr",
+		}},
+	}, n)
+}
+
+func TestParseTestTree_Error(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"a\nb",
+		"a\n\tb",
+		"a Unknown",
+		`a "foo`,
+	} {
+		_, err := ParseTestTree(s)
+		assert.NotNil(t, err, s)
+	}
+}
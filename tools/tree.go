@@ -0,0 +1,859 @@
+package tools
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// nonNilChildren returns the children of node without the nil ones, which all
+// the helpers of this package skip as if they were not there. The children
+// slice itself is returned if there is no nil child.
+func nonNilChildren(node *uast.Node) []*uast.Node {
+	for _, child := range node.Children {
+		if child == nil {
+			children := make([]*uast.Node, 0, len(node.Children))
+			for _, child := range node.Children {
+				if child != nil {
+					children = append(children, child)
+				}
+			}
+			return children
+		}
+	}
+	return node.Children
+}
+
+// walkPreOrder visits every node of the tree rooted at node in pre-order. It
+// uses an explicit stack so deeply nested trees do not overflow the goroutine
+// stack.
+func walkPreOrder(node *uast.Node, fn func(*uast.Node)) {
+	if node == nil {
+		return
+	}
+
+	stack := []*uast.Node{node}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		fn(n)
+
+		for i := len(n.Children) - 1; i >= 0; i-- {
+			if child := n.Children[i]; child != nil {
+				stack = append(stack, child)
+			}
+		}
+	}
+}
+
+// WalkStop can be returned by the function given to WalkErr to stop the walk
+// without failing.
+var WalkStop = errors.New("walk stopped")
+
+// Walk visits in pre-order every node of the tree rooted at node, calling fn
+// for each of them. Returning false from fn prunes the subtree of the node: its
+// descendants are not visited. The nil children are skipped. Walk is done in
+// Go, with an explicit stack, so it can run concurrently with any other call.
+func Walk(node *uast.Node, fn func(n *uast.Node) bool) {
+	WalkErr(node, func(n *uast.Node) (bool, error) {
+		return fn(n), nil
+	})
+}
+
+// WalkErr is like Walk but fn can also stop the whole walk by returning an
+// error, which WalkErr returns, except for WalkStop, which stops it returning
+// nil.
+func WalkErr(node *uast.Node, fn func(n *uast.Node) (bool, error)) error {
+	if node == nil {
+		return nil
+	}
+
+	stack := []*uast.Node{node}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		descend, err := fn(n)
+		if err == WalkStop {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !descend {
+			continue
+		}
+
+		for i := len(n.Children) - 1; i >= 0; i-- {
+			if child := n.Children[i]; child != nil {
+				stack = append(stack, child)
+			}
+		}
+	}
+	return nil
+}
+
+// WalkPostOrder visits every node of the tree rooted at node calling fn for
+// each of them, all the descendants of a node before the node itself, in the
+// same order as the PostOrder iterator. Like Walk, it is done in Go with an
+// explicit stack.
+func WalkPostOrder(node *uast.Node, fn func(n *uast.Node)) {
+	if node == nil {
+		return
+	}
+
+	type entry struct {
+		node *uast.Node
+		next int
+	}
+
+	stack := []entry{{node, 0}}
+	for len(stack) > 0 {
+		e := &stack[len(stack)-1]
+		if e.next < len(e.node.Children) {
+			child := e.node.Children[e.next]
+			e.next++
+			if child != nil {
+				stack = append(stack, entry{child, 0})
+			}
+			continue
+		}
+
+		stack = stack[:len(stack)-1]
+		fn(e.node)
+	}
+}
+
+// Parents walks the tree once and returns a map from every node under root to
+// its parent, with the root mapped to nil, so the tree can be navigated
+// upwards. The map is keyed by node identity and it is only valid as long as
+// the tree is not modified.
+func Parents(root *uast.Node) map[*uast.Node]*uast.Node {
+	parents := make(map[*uast.Node]*uast.Node)
+	if root == nil {
+		return parents
+	}
+
+	parents[root] = nil
+	walkPreOrder(root, func(n *uast.Node) {
+		for _, child := range nonNilChildren(n) {
+			parents[child] = n
+		}
+	})
+	return parents
+}
+
+// siblingIndex returns the parent of node and the position of node in its
+// children, or nil and -1 if it has no parent in the given map.
+func siblingIndex(parents map[*uast.Node]*uast.Node, node *uast.Node) (*uast.Node, int) {
+	parent := parents[node]
+	if parent == nil {
+		return nil, -1
+	}
+
+	for i, child := range parent.Children {
+		if child == node {
+			return parent, i
+		}
+	}
+	return nil, -1
+}
+
+// siblings returns the non-nil children of the parent of node, node included,
+// and the position of node among them, or nil and -1 if it has no parent in
+// the given map.
+func siblings(parents map[*uast.Node]*uast.Node, node *uast.Node) ([]*uast.Node, int) {
+	parent, _ := siblingIndex(parents, node)
+	if parent == nil {
+		return nil, -1
+	}
+
+	children := nonNilChildren(parent)
+	for i, child := range children {
+		if child == node {
+			return children, i
+		}
+	}
+	return nil, -1
+}
+
+// NextSibling returns the child that follows node in the children of its
+// parent, skipping the nil ones, or nil if node is the last one or it has no
+// parent. The parent is looked up in `parents`, as returned by Parents, which
+// must be up to date with the tree, and node is found among the children of
+// its parent by identity.
+func NextSibling(parents map[*uast.Node]*uast.Node, node *uast.Node) *uast.Node {
+	children, i := siblings(parents, node)
+	if children == nil || i+1 >= len(children) {
+		return nil
+	}
+	return children[i+1]
+}
+
+// PrevSibling returns the child that precedes node in the children of its
+// parent, skipping the nil ones, or nil if node is the first one or it has no
+// parent. Like NextSibling, it relies on an up to date `parents` map.
+func PrevSibling(parents map[*uast.Node]*uast.Node, node *uast.Node) *uast.Node {
+	children, i := siblings(parents, node)
+	if children == nil || i == 0 {
+		return nil
+	}
+	return children[i-1]
+}
+
+// CountNodes returns the number of nodes of the tree rooted at node, the root
+// included, or 0 for a nil node. Unlike DescendantCount, the tree is walked in
+// Go, with an explicit stack so deeply nested trees do not overflow the
+// goroutine stack.
+func CountNodes(node *uast.Node) int {
+	count := 0
+	walkPreOrder(node, func(*uast.Node) {
+		count++
+	})
+	return count
+}
+
+// CountForest returns the total number of nodes of the trees rooted at each of
+// the given nodes, as CountNodes counts them.
+func CountForest(nodes []*uast.Node) int {
+	count := 0
+	for _, n := range nodes {
+		count += CountNodes(n)
+	}
+	return count
+}
+
+// Tokens returns the non-empty tokens of the tree rooted at root, in
+// pre-order, repeated as many times as they appear.
+func Tokens(root *uast.Node) []string {
+	var tokens []string
+	walkPreOrder(root, func(n *uast.Node) {
+		if n.Token != "" {
+			tokens = append(tokens, n.Token)
+		}
+	})
+	return tokens
+}
+
+// TokenSet returns the number of occurrences of every non-empty token in the
+// tree rooted at root.
+func TokenSet(root *uast.Node) map[string]int {
+	set := make(map[string]int)
+	walkPreOrder(root, func(n *uast.Node) {
+		if n.Token != "" {
+			set[n.Token]++
+		}
+	})
+	return set
+}
+
+// RoleHistogram returns the number of occurrences of every role in the tree
+// rooted at root, counting each role of the Roles of every node, so a node
+// with a repeated role counts it twice. The roles with no occurrences are not
+// in the map.
+func RoleHistogram(root *uast.Node) map[uast.Role]int {
+	hist := make(map[uast.Role]int)
+	walkPreOrder(root, func(n *uast.Node) {
+		for _, r := range n.Roles {
+			hist[r]++
+		}
+	})
+	return hist
+}
+
+// InternalTypeHistogram returns the number of nodes of every internal type in
+// the tree rooted at root.
+func InternalTypeHistogram(root *uast.Node) map[string]int {
+	hist := make(map[string]int)
+	walkPreOrder(root, func(n *uast.Node) {
+		hist[n.InternalType]++
+	})
+	return hist
+}
+
+// Height returns the number of nodes in the longest path from node down to a
+// leaf: 1 for a single node and 0 for a nil node. It uses an explicit stack
+// so deeply nested trees do not overflow the goroutine stack.
+func Height(node *uast.Node) int {
+	if node == nil {
+		return 0
+	}
+
+	type entry struct {
+		node  *uast.Node
+		depth int
+	}
+
+	height := 0
+	stack := []entry{{node, 1}}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if e.depth > height {
+			height = e.depth
+		}
+
+		for _, child := range nonNilChildren(e.node) {
+			stack = append(stack, entry{child, e.depth + 1})
+		}
+	}
+	return height
+}
+
+// PathTo returns the chain of nodes from `root` down to `target`, both
+// included, comparing the nodes by identity. The returned bool is false, with
+// a nil path, if `target` is not under `root`.
+func PathTo(root, target *uast.Node) ([]*uast.Node, bool) {
+	if root == nil || target == nil {
+		return nil, false
+	}
+
+	type entry struct {
+		node  *uast.Node
+		depth int
+	}
+
+	var path []*uast.Node
+	stack := []entry{{root, 0}}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		path = append(path[:e.depth], e.node)
+		if e.node == target {
+			return path, true
+		}
+
+		for i := len(e.node.Children) - 1; i >= 0; i-- {
+			if child := e.node.Children[i]; child != nil {
+				stack = append(stack, entry{child, e.depth + 1})
+			}
+		}
+	}
+	return nil, false
+}
+
+// LowestCommonAncestor returns the deepest node under `root` (including
+// itself) having both `a` and `b` in its subtree, comparing the nodes by
+// identity, so if one of them is an ancestor of the other it is the one
+// returned. It returns nil if any of them is not under `root`.
+func LowestCommonAncestor(root, a, b *uast.Node) *uast.Node {
+	pathA, ok := PathTo(root, a)
+	if !ok {
+		return nil
+	}
+	pathB, ok := PathTo(root, b)
+	if !ok {
+		return nil
+	}
+
+	var lca *uast.Node
+	for i := 0; i < len(pathA) && i < len(pathB) && pathA[i] == pathB[i]; i++ {
+		lca = pathA[i]
+	}
+	return lca
+}
+
+// LeadingComments returns the sibling nodes of internal type `commentType`
+// found right before `node` in its parent's children, stopping at the first
+// sibling of any other type and skipping the nil ones. The comments are
+// returned in source order, that is, the one closest to `node` is the last
+// one. It returns nil if `node` is not under `root` or it is the root itself.
+func LeadingComments(root, node *uast.Node, commentType string) []*uast.Node {
+	children, idx := siblings(Parents(root), node)
+	if children == nil {
+		return nil
+	}
+
+	first := idx
+	for first > 0 && children[first-1].InternalType == commentType {
+		first--
+	}
+
+	if first == idx {
+		return nil
+	}
+
+	comments := make([]*uast.Node, idx-first)
+	copy(comments, children[first:idx])
+	return comments
+}
+
+// Snippet returns `node` surrounded by up to `radius` of its preceding and
+// following siblings under `root`, in the order they appear in the parent's
+// children, not counting the nil ones. The window is clamped at the first and
+// last children. If `node` has no parent under `root` (e.g. it is the root),
+// only the node is returned.
+func Snippet(root, node *uast.Node, radius int) []*uast.Node {
+	if node == nil {
+		return nil
+	}
+
+	children, idx := siblings(Parents(root), node)
+	if children == nil {
+		return []*uast.Node{node}
+	}
+
+	if radius < 0 {
+		radius = 0
+	}
+
+	first, last := idx-radius, idx+radius+1
+	if first < 0 {
+		first = 0
+	}
+	if last > len(children) {
+		last = len(children)
+	}
+
+	snippet := make([]*uast.Node, last-first)
+	copy(snippet, children[first:last])
+	return snippet
+}
+
+// Property returns the value of the property `key` of the node and whether it
+// is set, so an empty value can be told apart from a missing property. It is
+// false for a nil node.
+func Property(node *uast.Node, key string) (string, bool) {
+	if node == nil {
+		return "", false
+	}
+	value, ok := node.Properties[key]
+	return value, ok
+}
+
+// PropertyOr returns the value of the property `key` of the node, or `def` if
+// it is not set or the node is nil.
+func PropertyOr(node *uast.Node, key, def string) string {
+	if value, ok := Property(node, key); ok {
+		return value
+	}
+	return def
+}
+
+// rootWrappers are the internal types considered generic wrappers by
+// RootConstruct, like the `File` node some drivers put around the `Program`.
+var rootWrappers = []string{"File"}
+
+func isRootWrapper(wrappers []string, internalType string) bool {
+	if internalType == "" {
+		return true
+	}
+
+	for _, t := range wrappers {
+		if t == internalType {
+			return true
+		}
+	}
+	return false
+}
+
+// RootConstruct returns the internal type of the construct a tree represents,
+// like `Module`, `Program` or `CompilationUnit`. If the root type is empty or
+// it is `File`, a generic wrapper, it descends into the first child with a
+// non-empty internal type, repeating while that child is another wrapper. If
+// there is no such child, the root type is returned as is.
+func RootConstruct(node *uast.Node) string {
+	return RootConstructWith(node, rootWrappers)
+}
+
+// RootConstructWith is like RootConstruct but the generic wrappers are the
+// internal types in `wrappers`, for the drivers wrapping their trees in other
+// nodes than `File`.
+func RootConstructWith(node *uast.Node, wrappers []string) string {
+	if node == nil {
+		return ""
+	}
+
+	current := node
+	for isRootWrapper(wrappers, current.InternalType) {
+		var next *uast.Node
+		for _, child := range current.Children {
+			if child != nil && child.InternalType != "" {
+				next = child
+				break
+			}
+		}
+
+		if next == nil {
+			break
+		}
+		current = next
+	}
+
+	if current.InternalType == "" {
+		return node.InternalType
+	}
+	return current.InternalType
+}
+
+func positionEqual(a, b *uast.Position) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// shallowEqual compares all the fields of two nodes but their children.
+func shallowEqual(a, b *uast.Node) bool {
+	return positionEqual(a.StartPosition, b.StartPosition) &&
+		positionEqual(a.EndPosition, b.EndPosition) && contentEqual(a, b)
+}
+
+// contentEqual compares the internal type, token, roles and properties of two
+// nodes.
+func contentEqual(a, b *uast.Node) bool {
+	if a.InternalType != b.InternalType || a.Token != b.Token ||
+		len(a.Roles) != len(b.Roles) || len(a.Properties) != len(b.Properties) {
+		return false
+	}
+
+	for i, r := range a.Roles {
+		if b.Roles[i] != r {
+			return false
+		}
+	}
+
+	for k, v := range a.Properties {
+		if bv, ok := b.Properties[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal reports whether the trees rooted at `a` and `b` are structurally
+// equal: both nodes have the same internal type, token, roles in the same
+// order, properties and positions, and their children are equal one by one.
+// A nil and an empty properties map or roles list are equal, and the nil
+// children are skipped. Two nil nodes are equal, but a nil one is not equal to
+// any other node.
+func Equal(a, b *uast.Node) bool {
+	type pair struct{ a, b *uast.Node }
+	stack := []pair{{a, b}}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if p.a == nil || p.b == nil {
+			if p.a != p.b {
+				return false
+			}
+			continue
+		}
+
+		ac, bc := nonNilChildren(p.a), nonNilChildren(p.b)
+		if len(ac) != len(bc) || !shallowEqual(p.a, p.b) {
+			return false
+		}
+
+		for i := range ac {
+			stack = append(stack, pair{ac[i], bc[i]})
+		}
+	}
+	return true
+}
+
+// ChangedNodes walks both trees in lockstep, pairing the children of both
+// sides by their index, skipping the nil ones, and returns in pre-order the
+// nodes of `new` that are different from their counterpart in `old`. A node
+// is different when any of its fields but the children is different, or when
+// it has a different number of children; in both cases the node is returned
+// as a whole and its subtree is not inspected any further, so when children
+// are added or removed their parent is reported. If `old` is nil, `new` is
+// returned as changed.
+func ChangedNodes(old, new *uast.Node) ([]*uast.Node, error) {
+	if new == nil {
+		return nil, nil
+	}
+
+	var changed []*uast.Node
+	type pair struct{ old, new *uast.Node }
+	stack := []pair{{old, new}}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if p.old == nil {
+			changed = append(changed, p.new)
+			continue
+		}
+
+		oc, nc := nonNilChildren(p.old), nonNilChildren(p.new)
+		if len(oc) != len(nc) || !shallowEqual(p.old, p.new) {
+			changed = append(changed, p.new)
+			continue
+		}
+
+		for i := len(nc) - 1; i >= 0; i-- {
+			stack = append(stack, pair{oc[i], nc[i]})
+		}
+	}
+	return changed, nil
+}
+
+// Clone returns a deep copy of the tree rooted at node, which shares no
+// mutable state with the original: the children, roles, properties and
+// positions are copied too, but the nil children are left out. It returns nil
+// for a nil node.
+func Clone(node *uast.Node) *uast.Node {
+	if node == nil {
+		return nil
+	}
+
+	c := shallowClone(node)
+	if node.Children != nil {
+		children := nonNilChildren(node)
+		c.Children = make([]*uast.Node, len(children))
+		for i, child := range children {
+			c.Children[i] = Clone(child)
+		}
+	}
+	return c
+}
+
+// shallowClone returns a copy of the node as Clone does, but without children.
+func shallowClone(node *uast.Node) *uast.Node {
+	c := &uast.Node{
+		InternalType: node.InternalType,
+		Token:        node.Token,
+	}
+
+	if node.Properties != nil {
+		c.Properties = make(map[string]string, len(node.Properties))
+		for k, v := range node.Properties {
+			c.Properties[k] = v
+		}
+	}
+
+	if node.Roles != nil {
+		c.Roles = make([]uast.Role, len(node.Roles))
+		copy(c.Roles, node.Roles)
+	}
+
+	if node.StartPosition != nil {
+		p := *node.StartPosition
+		c.StartPosition = &p
+	}
+
+	if node.EndPosition != nil {
+		p := *node.EndPosition
+		c.EndPosition = &p
+	}
+	return c
+}
+
+// Replace returns a copy of the tree rooted at root, as Clone makes it, where
+// every node that is a key of `replacements` (matched by pointer identity) is
+// swapped for its value, or deleted from the children of its parent if the
+// value is nil. The tree is rebuilt from the root down, so the subtree of a
+// replaced node is not looked into, and the replacements are used as they are,
+// neither cloned nor looked into for more replacements. The original tree is
+// not modified. The keys not found in the tree are ignored, and nil is
+// returned if the root itself is deleted.
+func Replace(root *uast.Node, replacements map[*uast.Node]*uast.Node) *uast.Node {
+	if r, ok := replacements[root]; ok {
+		return r
+	}
+	if root == nil {
+		return nil
+	}
+
+	c := shallowClone(root)
+	if root.Children != nil {
+		c.Children = make([]*uast.Node, 0, len(root.Children))
+		for _, child := range nonNilChildren(root) {
+			if r, ok := replacements[child]; ok && r == nil {
+				continue
+			}
+			c.Children = append(c.Children, Replace(child, replacements))
+		}
+	}
+	return c
+}
+
+// Marker tags nodes with arbitrary labels so they can be collected later,
+// e.g. to classify nodes in several categories during a single walk. Marks are
+// keyed by the node pointer, so they are not valid anymore if the tree is
+// modified or copied. A Marker is not safe for concurrent use.
+type Marker struct {
+	tagged map[string][]*uast.Node
+	marks  map[string]map[*uast.Node]bool
+}
+
+// NewMarker returns an empty Marker.
+func NewMarker() *Marker {
+	return &Marker{
+		tagged: make(map[string][]*uast.Node),
+		marks:  make(map[string]map[*uast.Node]bool),
+	}
+}
+
+// Mark tags the node with the given tag. Marking a node twice with the same tag
+// has no effect.
+func (m *Marker) Mark(node *uast.Node, tag string) {
+	marks, ok := m.marks[tag]
+	if !ok {
+		marks = make(map[*uast.Node]bool)
+		m.marks[tag] = marks
+	}
+
+	if marks[node] {
+		return
+	}
+	marks[node] = true
+	m.tagged[tag] = append(m.tagged[tag], node)
+}
+
+// Marked reports whether the node has been tagged with the given tag.
+func (m *Marker) Marked(node *uast.Node, tag string) bool {
+	return m.marks[tag][node]
+}
+
+// Collect returns the nodes tagged with the given tag, in the order they were
+// first marked.
+func (m *Marker) Collect(tag string) []*uast.Node {
+	nodes := make([]*uast.Node, len(m.tagged[tag]))
+	copy(nodes, m.tagged[tag])
+	return nodes
+}
+
+// ReplaceSubtree returns a new tree where the node `old` (matched by pointer
+// identity) is replaced by `new`. The original tree is not modified: only the
+// ancestors of `old` are copied, the rest of the subtrees are shared by both
+// trees. An *ErrInvalidArgument error is returned if `old` is not under `root`.
+func ReplaceSubtree(root, old, new *uast.Node) (*uast.Node, error) {
+	if old == root {
+		return new, nil
+	}
+
+	parents := Parents(root)
+	if _, ok := parents[old]; !ok || old == nil {
+		return nil, &ErrInvalidArgument{Message: "node not found in tree"}
+	}
+
+	current, replacement := old, new
+	for current != root {
+		parent, idx := siblingIndex(parents, current)
+		c := *parent
+		c.Children = make([]*uast.Node, len(parent.Children))
+		copy(c.Children, parent.Children)
+		c.Children[idx] = replacement
+
+		current, replacement = parent, &c
+	}
+	return replacement, nil
+}
+
+// PruneOptions change how PruneWithOptions removes the nodes.
+type PruneOptions struct {
+	// PromoteChildren puts the children of every removed node in its place,
+	// instead of removing them with it. The children are still checked, so
+	// they can be removed too.
+	PromoteChildren bool
+}
+
+// Prune returns a copy of the tree rooted at root without the nodes for
+// which `remove` returns true, which are removed together with their
+// subtrees. It returns nil if the root itself is removed. The input tree is
+// not modified.
+func Prune(root *uast.Node, remove func(n *uast.Node) bool) *uast.Node {
+	return PruneWithOptions(root, remove, PruneOptions{})
+}
+
+// PruneWithOptions is like Prune but the removal can be changed with `opts`,
+// e.g. to keep the children of the removed nodes. The root is never promoted:
+// nil is returned if it is removed.
+func PruneWithOptions(root *uast.Node, remove func(n *uast.Node) bool, opts PruneOptions) *uast.Node {
+	if root == nil || remove(root) {
+		return nil
+	}
+	return prune(root, remove, opts, true)[0]
+}
+
+func prune(node *uast.Node, remove func(n *uast.Node) bool, opts PruneOptions, root bool) []*uast.Node {
+	removed := !root && remove(node)
+	if removed && !opts.PromoteChildren {
+		return nil
+	}
+
+	var children []*uast.Node
+	for _, child := range nonNilChildren(node) {
+		children = append(children, prune(child, remove, opts, false)...)
+	}
+
+	if removed {
+		return children
+	}
+
+	orig := *node
+	orig.Children = nil
+	n := Clone(&orig)
+	n.Children = children
+	return []*uast.Node{n}
+}
+
+// NormalizeOptions are the normalizations applied by Normalize.
+type NormalizeOptions struct {
+	// StripPositions removes the start and end positions of every node.
+	StripPositions bool
+	// SortRoles sorts the roles of every node by their ID, removing the
+	// duplicated ones. Properties are a map, so they need no sorting.
+	SortRoles bool
+	// DropSynthetic removes the nodes with neither start nor end position,
+	// which are not backed by the source, putting their children in their
+	// place. The root is never removed.
+	DropSynthetic bool
+	// LowercaseTypes converts all the internal types to lower case.
+	LowercaseTypes bool
+}
+
+// Normalize returns a normalized copy of the tree rooted at node, so trees
+// produced by different drivers for the same code can be compared. The input
+// tree is not modified.
+func Normalize(node *uast.Node, opts NormalizeOptions) *uast.Node {
+	if node == nil {
+		return nil
+	}
+	return normalize(node, opts, true)[0]
+}
+
+func normalize(node *uast.Node, opts NormalizeOptions, root bool) []*uast.Node {
+	var children []*uast.Node
+	for _, child := range nonNilChildren(node) {
+		children = append(children, normalize(child, opts, false)...)
+	}
+
+	if opts.DropSynthetic && !root && node.StartPosition == nil && node.EndPosition == nil {
+		return children
+	}
+
+	orig := *node
+	orig.Children = nil
+	n := Clone(&orig)
+	n.Children = children
+
+	if opts.StripPositions {
+		n.StartPosition = nil
+		n.EndPosition = nil
+	}
+
+	if opts.SortRoles && len(n.Roles) > 0 {
+		sort.Slice(n.Roles, func(i, j int) bool { return n.Roles[i] < n.Roles[j] })
+		roles := n.Roles[:1]
+		for _, r := range n.Roles[1:] {
+			if r != roles[len(roles)-1] {
+				roles = append(roles, r)
+			}
+		}
+		n.Roles = roles
+	}
+
+	if opts.LowercaseTypes {
+		n.InternalType = strings.ToLower(n.InternalType)
+	}
+	return []*uast.Node{n}
+}
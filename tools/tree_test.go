@@ -0,0 +1,675 @@
+package tools
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+// deepTree returns a tree with a single chain of `depth` nodes.
+func deepTree(depth int) *uast.Node {
+	root := &uast.Node{InternalType: "deep"}
+	n := root
+	for i := 1; i < depth; i++ {
+		child := &uast.Node{InternalType: "deep"}
+		n.Children = []*uast.Node{child}
+		n = child
+	}
+	return root
+}
+
+func TestCountNodes(t *testing.T) {
+	n := nodeTree()
+	assert.Equal(t, 5, CountNodes(n))
+	assert.Equal(t, 3, CountNodes(n.Children[1]))
+	assert.Equal(t, 1, CountNodes(n.Children[0]))
+	assert.Equal(t, 0, CountNodes(nil))
+	assert.Equal(t, 100000, CountNodes(deepTree(100000)))
+
+	assert.Equal(t, 4, CountForest(n.Children))
+	assert.Equal(t, 0, CountForest(nil))
+}
+
+func TestWalk(t *testing.T) {
+	var types []string
+	Walk(nodeTree(), func(n *uast.Node) bool {
+		types = append(types, n.InternalType)
+		return true
+	})
+	assert.Equal(t, []string{"parent", "child1", "child2", "subchild21", "subchild22"}, types)
+
+	types = nil
+	Walk(nodeTree(), func(n *uast.Node) bool {
+		types = append(types, n.InternalType)
+		return n.InternalType != "child2"
+	})
+	assert.Equal(t, []string{"parent", "child1", "child2"}, types)
+
+	Walk(nil, func(n *uast.Node) bool {
+		t.Fatal("nil node visited")
+		return true
+	})
+
+	count := 0
+	Walk(deepTree(100000), func(n *uast.Node) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 100000, count)
+}
+
+func TestWalkErr(t *testing.T) {
+	var types []string
+	err := WalkErr(nodeTree(), func(n *uast.Node) (bool, error) {
+		types = append(types, n.InternalType)
+		if n.InternalType == "subchild21" {
+			return true, WalkStop
+		}
+		return n.InternalType != "child1", nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"parent", "child1", "child2", "subchild21"}, types)
+
+	failed := errors.New("failed")
+	types = nil
+	err = WalkErr(nodeTree(), func(n *uast.Node) (bool, error) {
+		types = append(types, n.InternalType)
+		if n.InternalType == "child1" {
+			return true, failed
+		}
+		return true, nil
+	})
+	assert.Equal(t, failed, err)
+	assert.Equal(t, []string{"parent", "child1"}, types)
+}
+
+func TestWalkPostOrder(t *testing.T) {
+	n := nodeTree()
+	iter, err := NewIterator(n, PostOrder)
+	assert.Nil(t, err)
+	defer iter.Dispose()
+
+	var expected []*uast.Node
+	for node := range iter.Iterate() {
+		expected = append(expected, node)
+	}
+
+	var nodes []*uast.Node
+	visited := make(map[*uast.Node]bool)
+	WalkPostOrder(n, func(node *uast.Node) {
+		for _, child := range node.Children {
+			assert.True(t, visited[child], "%s visited before %s", node.InternalType, child.InternalType)
+		}
+		visited[node] = true
+		nodes = append(nodes, node)
+	})
+	assert.Equal(t, expected, nodes)
+
+	WalkPostOrder(nil, func(*uast.Node) {
+		t.Fatal("nil node visited")
+	})
+
+	var last *uast.Node
+	count := 0
+	deep := deepTree(100000)
+	WalkPostOrder(deep, func(node *uast.Node) {
+		count++
+		last = node
+	})
+	assert.Equal(t, 100000, count)
+	assert.Equal(t, deep, last)
+}
+
+func TestTokens(t *testing.T) {
+	n := nodeTree()
+	n.Token = "b"
+	n.Children[0].Token = "a"
+	n.Children[1].Children[0].Token = "b"
+	n.Children[1].Children[1].Token = "c"
+
+	assert.Equal(t, []string{"b", "a", "b", "c"}, Tokens(n))
+	assert.Equal(t, map[string]int{"a": 1, "b": 2, "c": 1}, TokenSet(n))
+
+	assert.Len(t, Tokens(nodeTree()), 0)
+	assert.Len(t, TokenSet(nodeTree()), 0)
+	assert.Len(t, Tokens(nil), 0)
+}
+
+func TestRoleHistogram(t *testing.T) {
+	n := nodeTree()
+	n.Roles = []uast.Role{uast.File}
+	n.Children[0].Roles = []uast.Role{uast.Identifier, uast.Expression}
+	n.Children[1].Children[0].Roles = []uast.Role{uast.Identifier}
+	n.Children[1].Children[1].Roles = []uast.Role{uast.Identifier, uast.Identifier}
+
+	assert.Equal(t, map[uast.Role]int{
+		uast.File:       1,
+		uast.Identifier: 4,
+		uast.Expression: 1,
+	}, RoleHistogram(n))
+	assert.Len(t, RoleHistogram(nil), 0)
+}
+
+func TestInternalTypeHistogram(t *testing.T) {
+	n := nodeTree()
+	n.Children[1].Children[1].InternalType = "subchild21"
+
+	assert.Equal(t, map[string]int{
+		"parent":     1,
+		"child1":     1,
+		"child2":     1,
+		"subchild21": 2,
+	}, InternalTypeHistogram(n))
+	assert.Len(t, InternalTypeHistogram(nil), 0)
+}
+
+func TestHeight(t *testing.T) {
+	n := nodeTree()
+	assert.Equal(t, 3, Height(n))
+	assert.Equal(t, 2, Height(n.Children[1]))
+	assert.Equal(t, 1, Height(n.Children[0]))
+	assert.Equal(t, 0, Height(nil))
+
+	// a skewed tree: every node has a leaf child and a deeper child
+	skewed := &uast.Node{}
+	last := skewed
+	for i := 0; i < 9; i++ {
+		child := &uast.Node{}
+		last.Children = []*uast.Node{child, {}}
+		last = child
+	}
+	assert.Equal(t, 10, Height(skewed))
+	assert.Equal(t, 100000, Height(deepTree(100000)))
+}
+
+func TestProperty(t *testing.T) {
+	n := &uast.Node{Properties: map[string]string{"k": "v", "empty": ""}}
+
+	v, ok := Property(n, "k")
+	assert.True(t, ok)
+	assert.Equal(t, "v", v)
+
+	v, ok = Property(n, "empty")
+	assert.True(t, ok)
+	assert.Equal(t, "", v)
+
+	_, ok = Property(n, "missing")
+	assert.False(t, ok)
+	_, ok = Property(&uast.Node{}, "k")
+	assert.False(t, ok)
+	_, ok = Property(nil, "k")
+	assert.False(t, ok)
+
+	assert.Equal(t, "v", PropertyOr(n, "k", "def"))
+	assert.Equal(t, "", PropertyOr(n, "empty", "def"))
+	assert.Equal(t, "def", PropertyOr(n, "missing", "def"))
+	assert.Equal(t, "def", PropertyOr(nil, "k", "def"))
+}
+
+func TestPathTo(t *testing.T) {
+	n := nodeTree()
+	child2 := n.Children[1]
+
+	path, ok := PathTo(n, child2.Children[1])
+	assert.True(t, ok)
+	assert.Equal(t, []*uast.Node{n, child2, child2.Children[1]}, path)
+
+	path, ok = PathTo(n, n)
+	assert.True(t, ok)
+	assert.Equal(t, []*uast.Node{n}, path)
+
+	path, ok = PathTo(n, n.Children[0])
+	assert.True(t, ok)
+	assert.Equal(t, []*uast.Node{n, n.Children[0]}, path)
+
+	path, ok = PathTo(child2, n)
+	assert.False(t, ok)
+	assert.Nil(t, path)
+
+	_, ok = PathTo(n, &uast.Node{InternalType: "child1"})
+	assert.False(t, ok)
+
+	_, ok = PathTo(nil, n)
+	assert.False(t, ok)
+}
+
+func TestLowestCommonAncestor(t *testing.T) {
+	n := nodeTree()
+	child1, child2 := n.Children[0], n.Children[1]
+	sub21, sub22 := child2.Children[0], child2.Children[1]
+	sub21.Children = []*uast.Node{{InternalType: "leaf"}}
+	leaf := sub21.Children[0]
+
+	// siblings and cousins
+	assert.True(t, LowestCommonAncestor(n, sub21, sub22) == child2)
+	assert.True(t, LowestCommonAncestor(n, leaf, sub22) == child2)
+	assert.True(t, LowestCommonAncestor(n, child1, leaf) == n)
+
+	// parent and child, in both orders
+	assert.True(t, LowestCommonAncestor(n, child2, leaf) == child2)
+	assert.True(t, LowestCommonAncestor(n, leaf, child2) == child2)
+	assert.True(t, LowestCommonAncestor(n, n, sub22) == n)
+	assert.True(t, LowestCommonAncestor(n, leaf, leaf) == leaf)
+
+	// disjoint nodes
+	assert.Nil(t, LowestCommonAncestor(n, leaf, &uast.Node{}))
+	assert.Nil(t, LowestCommonAncestor(child1, child1, sub21))
+	assert.Nil(t, LowestCommonAncestor(n, nil, sub21))
+	assert.Nil(t, LowestCommonAncestor(nil, sub21, sub22))
+}
+
+func TestParents(t *testing.T) {
+	n := nodeTree()
+	child2 := n.Children[1]
+
+	parents := Parents(n)
+	assert.Equal(t, map[*uast.Node]*uast.Node{
+		n:                  nil,
+		n.Children[0]:      n,
+		child2:             n,
+		child2.Children[0]: child2,
+		child2.Children[1]: child2,
+	}, parents)
+
+	p, ok := parents[n]
+	assert.True(t, ok)
+	assert.Nil(t, p)
+
+	assert.Len(t, Parents(nil), 0)
+}
+
+func TestSiblings(t *testing.T) {
+	n := nodeTree()
+	n.Children = append(n.Children, &uast.Node{InternalType: "child3"})
+	child1, child2, child3 := n.Children[0], n.Children[1], n.Children[2]
+	parents := Parents(n)
+
+	assert.True(t, NextSibling(parents, child1) == child2)
+	assert.True(t, NextSibling(parents, child2) == child3)
+	assert.Nil(t, NextSibling(parents, child3))
+	assert.Nil(t, PrevSibling(parents, child1))
+	assert.True(t, PrevSibling(parents, child2) == child1)
+	assert.True(t, PrevSibling(parents, child3) == child2)
+
+	assert.True(t, NextSibling(parents, child2.Children[0]) == child2.Children[1])
+	assert.Nil(t, NextSibling(parents, child2.Children[1]))
+
+	assert.Nil(t, NextSibling(parents, n))
+	assert.Nil(t, PrevSibling(parents, n))
+	assert.Nil(t, NextSibling(parents, &uast.Node{}))
+	assert.Nil(t, PrevSibling(parents, nil))
+}
+
+func TestClone(t *testing.T) {
+	n := nodeTree()
+	n.Token = "token"
+	n.Roles = []uast.Role{uast.File}
+	n.Properties = map[string]string{"k": "v"}
+	n.StartPosition = &uast.Position{Offset: 1, Line: 1, Col: 2}
+	n.EndPosition = &uast.Position{Offset: 5, Line: 1, Col: 6}
+
+	c := Clone(n)
+	assert.Equal(t, n, c)
+
+	c.Properties["k"] = "changed"
+	c.Properties["other"] = "value"
+	c.Roles[0] = uast.Identifier
+	c.StartPosition.Offset = 10
+	c.EndPosition.Line = 3
+	c.Children[1].Children[0].InternalType = "changed"
+	c.Children = c.Children[:1]
+
+	assert.Equal(t, map[string]string{"k": "v"}, n.Properties)
+	assert.Equal(t, []uast.Role{uast.File}, n.Roles)
+	assert.Equal(t, uint32(1), n.StartPosition.Offset)
+	assert.Equal(t, uint32(1), n.EndPosition.Line)
+	assert.Len(t, n.Children, 2)
+	assert.Equal(t, "subchild21", n.Children[1].Children[0].InternalType)
+
+	assert.Nil(t, Clone(nil))
+}
+
+func TestEqual(t *testing.T) {
+	a := nodeTree()
+	a.Properties = map[string]string{"a": "1", "b": "2"}
+	a.Roles = []uast.Role{uast.File, uast.Module}
+	a.Children[0].StartPosition = &uast.Position{Offset: 1, Line: 1, Col: 2}
+
+	b := Clone(a)
+	b.Properties = map[string]string{"b": "2", "a": "1"}
+	assert.True(t, Equal(a, b))
+	assert.True(t, Equal(a, a))
+
+	b.Children[0].StartPosition = &uast.Position{Offset: 1, Line: 1, Col: 3}
+	assert.False(t, Equal(a, b))
+	b.Children[0].StartPosition = nil
+	assert.False(t, Equal(a, b))
+
+	b = Clone(a)
+	b.Children[1].Children = b.Children[1].Children[:1]
+	assert.False(t, Equal(a, b))
+
+	b = Clone(a)
+	b.Properties["b"] = "3"
+	assert.False(t, Equal(a, b))
+
+	b = Clone(a)
+	b.Roles = []uast.Role{uast.Module, uast.File}
+	assert.False(t, Equal(a, b))
+
+	b = Clone(a)
+	b.Children[1].Children[1].Token = "changed"
+	assert.False(t, Equal(a, b))
+
+	assert.True(t, Equal(&uast.Node{Properties: map[string]string{}}, &uast.Node{}))
+	assert.True(t, Equal(nil, nil))
+	assert.False(t, Equal(a, nil))
+	assert.False(t, Equal(nil, a))
+}
+
+func TestLeadingComments(t *testing.T) {
+	c1 := &uast.Node{InternalType: "comment"}
+	c2 := &uast.Node{InternalType: "comment"}
+	c3 := &uast.Node{InternalType: "comment"}
+	stmt := &uast.Node{InternalType: "stmt"}
+	decl := &uast.Node{InternalType: "decl"}
+	root := &uast.Node{
+		InternalType: "file",
+		Children:     []*uast.Node{c1, stmt, c2, c3, decl},
+	}
+
+	assert.Equal(t, []*uast.Node{c2, c3}, LeadingComments(root, decl, "comment"))
+	assert.Equal(t, []*uast.Node{c1}, LeadingComments(root, stmt, "comment"))
+	assert.Len(t, LeadingComments(root, c1, "comment"), 0)
+	assert.Len(t, LeadingComments(root, root, "comment"), 0)
+	assert.Len(t, LeadingComments(root, &uast.Node{}, "comment"), 0)
+}
+
+func TestSnippet(t *testing.T) {
+	root := nodeTree()
+	child1, child2 := root.Children[0], root.Children[1]
+	sub21, sub22 := child2.Children[0], child2.Children[1]
+
+	assert.Equal(t, []*uast.Node{child1, child2}, Snippet(root, child1, 1))
+	assert.Equal(t, []*uast.Node{sub21, sub22}, Snippet(root, sub22, 5))
+	assert.Equal(t, []*uast.Node{sub21}, Snippet(root, sub21, 0))
+	assert.Equal(t, []*uast.Node{root}, Snippet(root, root, 1))
+	assert.Len(t, Snippet(root, nil, 1), 0)
+}
+
+func TestRootConstruct(t *testing.T) {
+	assert.Equal(t, "Module", RootConstruct(&uast.Node{InternalType: "Module"}))
+
+	wrapped := &uast.Node{
+		InternalType: "File",
+		Children: []*uast.Node{
+			{InternalType: ""},
+			{InternalType: "Program"},
+		},
+	}
+	assert.Equal(t, "Program", RootConstruct(wrapped))
+
+	assert.Equal(t, "File", RootConstruct(&uast.Node{InternalType: "File"}))
+	assert.Equal(t, "", RootConstruct(nil))
+
+	wrapped.InternalType = "Source"
+	assert.Equal(t, "Source", RootConstruct(wrapped))
+	assert.Equal(t, "Program", RootConstructWith(wrapped, []string{"Source"}))
+	assert.Equal(t, "Source", RootConstructWith(wrapped, nil))
+
+	wrapped.Children = append([]*uast.Node{nil}, wrapped.Children...)
+	assert.Equal(t, "Program", RootConstructWith(wrapped, []string{"Source"}))
+}
+
+// nilChildrenTree is nodeTree with nil children around and between the
+// children of every node.
+func nilChildrenTree() *uast.Node {
+	n := nodeTree()
+	walkPreOrder(n, func(n *uast.Node) {
+		var children []*uast.Node
+		for _, child := range n.Children {
+			children = append(children, nil, child)
+		}
+		n.Children = append(children, nil)
+	})
+	return n
+}
+
+func TestNilChildren(t *testing.T) {
+	n := nilChildrenTree()
+	child1, child2 := n.Children[1], n.Children[3]
+	sub21, sub22 := child2.Children[1], child2.Children[3]
+
+	var types []string
+	Walk(n, func(n *uast.Node) bool {
+		types = append(types, n.InternalType)
+		return true
+	})
+	assert.Equal(t, []string{"parent", "child1", "child2", "subchild21", "subchild22"}, types)
+
+	types = nil
+	WalkPostOrder(n, func(n *uast.Node) {
+		types = append(types, n.InternalType)
+	})
+	assert.Equal(t, []string{"child1", "subchild21", "subchild22", "child2", "parent"}, types)
+
+	assert.Equal(t, 5, CountNodes(n))
+	assert.Equal(t, 3, Height(n))
+	assert.Len(t, Parents(n), 5)
+
+	path, ok := PathTo(n, sub22)
+	assert.True(t, ok)
+	assert.Equal(t, []*uast.Node{n, child2, sub22}, path)
+
+	parents := Parents(n)
+	assert.Equal(t, child2, NextSibling(parents, child1))
+	assert.Nil(t, NextSibling(parents, child2))
+	assert.Equal(t, sub21, PrevSibling(parents, sub22))
+	assert.Nil(t, PrevSibling(parents, sub21))
+	assert.Equal(t, []*uast.Node{child1, child2}, Snippet(n, child2, 1))
+	assert.Equal(t, []*uast.Node{sub21}, LeadingComments(n, sub22, "subchild21"))
+
+	assert.True(t, Equal(nodeTree(), n))
+	changed, err := ChangedNodes(nodeTree(), n)
+	assert.Nil(t, err)
+	assert.Len(t, changed, 0)
+
+	c := Clone(n)
+	assert.Len(t, c.Children, 2)
+	assert.True(t, Equal(nodeTree(), c))
+	assert.True(t, Equal(nodeTree(), Replace(n, nil)))
+	assert.True(t, Equal(nodeTree(), Normalize(n, NormalizeOptions{})))
+	assert.True(t, Equal(nodeTree(), Prune(n, func(*uast.Node) bool { return false })))
+
+	data, err := ToJSON(n)
+	assert.Nil(t, err)
+	expected, err := ToJSON(nodeTree())
+	assert.Nil(t, err)
+	assert.Equal(t, string(expected), string(data))
+}
+
+func TestChangedNodes(t *testing.T) {
+	old := nodeTree()
+
+	r, err := ChangedNodes(old, nodeTree())
+	assert.Nil(t, err)
+	assert.Len(t, r, 0)
+
+	changed := nodeTree()
+	changed.Children[0].Token = "foo"
+	changed.Children[1].Children[1].Properties = map[string]string{"k": "v"}
+	r, err = ChangedNodes(old, changed)
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{changed.Children[0], changed.Children[1].Children[1]}, r)
+
+	added := nodeTree()
+	added.Children[1].Children = append(added.Children[1].Children, &uast.Node{})
+	r, err = ChangedNodes(old, added)
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{added.Children[1]}, r)
+
+	r, err = ChangedNodes(nil, added)
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{added}, r)
+}
+
+func TestMarker(t *testing.T) {
+	root := nodeTree()
+	m := NewMarker()
+
+	walkPreOrder(root, func(n *uast.Node) {
+		if len(n.Children) == 0 {
+			m.Mark(n, "leaf")
+		} else {
+			m.Mark(n, "inner")
+		}
+	})
+	m.Mark(root, "inner")
+
+	assert.Equal(t, []*uast.Node{root, root.Children[1]}, m.Collect("inner"))
+	assert.Len(t, m.Collect("leaf"), 3)
+	assert.Len(t, m.Collect("other"), 0)
+	assert.True(t, m.Marked(root, "inner"))
+	assert.False(t, m.Marked(root, "leaf"))
+}
+
+func TestReplace(t *testing.T) {
+	root := nodeTree()
+	child1, child2 := root.Children[0], root.Children[1]
+	sub21, sub22 := child2.Children[0], child2.Children[1]
+	leaf := &uast.Node{InternalType: "leaf"}
+	interior := &uast.Node{InternalType: "interior", Children: []*uast.Node{{InternalType: "x"}}}
+
+	r := Replace(root, map[*uast.Node]*uast.Node{sub22: leaf})
+	assert.Equal(t, "leaf", r.Children[1].Children[1].InternalType)
+	assert.True(t, r.Children[1].Children[1] == leaf)
+	assert.False(t, r.Children[1].Children[0] == sub21)
+	assert.Equal(t, sub21, r.Children[1].Children[0])
+	assert.True(t, child2.Children[1] == sub22, "the original tree is not modified")
+
+	r = Replace(root, map[*uast.Node]*uast.Node{child2: interior, sub21: leaf})
+	assert.Equal(t, []*uast.Node{child1, interior}, r.Children)
+	assert.True(t, r.Children[1] == interior)
+
+	r = Replace(root, map[*uast.Node]*uast.Node{sub21: nil, child1: nil})
+	assert.Len(t, r.Children, 1)
+	assert.Equal(t, []*uast.Node{sub22}, r.Children[0].Children)
+	assert.Len(t, child2.Children, 2)
+
+	r = Replace(root, nil)
+	assert.True(t, Equal(root, r))
+	assert.False(t, r == root)
+
+	assert.Nil(t, Replace(root, map[*uast.Node]*uast.Node{root: nil}))
+	assert.True(t, Replace(root, map[*uast.Node]*uast.Node{root: leaf}) == leaf)
+}
+
+func TestReplaceSubtree(t *testing.T) {
+	root := nodeTree()
+	child1, child2 := root.Children[0], root.Children[1]
+	sub22 := child2.Children[1]
+	replacement := &uast.Node{InternalType: "new"}
+
+	r, err := ReplaceSubtree(root, sub22, replacement)
+	assert.Nil(t, err)
+	assert.False(t, r == root)
+	assert.True(t, r.Children[0] == child1)
+	assert.True(t, r.Children[1].Children[0] == child2.Children[0])
+	assert.True(t, r.Children[1].Children[1] == replacement)
+	assert.True(t, child2.Children[1] == sub22)
+	assert.Equal(t, nodeTree(), root)
+
+	r, err = ReplaceSubtree(root, root, replacement)
+	assert.Nil(t, err)
+	assert.True(t, r == replacement)
+
+	_, err = ReplaceSubtree(root, &uast.Node{}, replacement)
+	assert.IsType(t, &ErrInvalidArgument{}, err)
+}
+
+func TestPrune(t *testing.T) {
+	types := func(n *uast.Node) []string {
+		var types []string
+		Walk(n, func(n *uast.Node) bool {
+			types = append(types, n.InternalType)
+			return true
+		})
+		return types
+	}
+	byType := func(types ...string) func(n *uast.Node) bool {
+		return func(n *uast.Node) bool {
+			for _, typ := range types {
+				if n.InternalType == typ {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	orig := nodeTree()
+
+	// a leaf
+	p := Prune(orig, byType("subchild21"))
+	assert.Equal(t, []string{"parent", "child1", "child2", "subchild22"}, types(p))
+
+	// an interior node, with its subtree
+	p = Prune(orig, byType("child2"))
+	assert.Equal(t, []string{"parent", "child1"}, types(p))
+
+	// an interior node, promoting its children
+	opts := PruneOptions{PromoteChildren: true}
+	p = PruneWithOptions(orig, byType("child2"), opts)
+	assert.Equal(t, []string{"parent", "child1", "subchild21", "subchild22"}, types(p))
+
+	// promoted children can be removed too
+	p = PruneWithOptions(orig, byType("child2", "subchild22"), opts)
+	assert.Equal(t, []string{"parent", "child1", "subchild21"}, types(p))
+
+	assert.Nil(t, Prune(orig, byType("parent")))
+	assert.Nil(t, PruneWithOptions(orig, byType("parent"), opts))
+	assert.Nil(t, Prune(nil, byType("parent")))
+
+	p = Prune(orig, byType())
+	assert.True(t, Equal(orig, p))
+	assert.False(t, p == orig)
+	assert.Equal(t, nodeTree(), orig)
+}
+
+func TestNormalize(t *testing.T) {
+	pos := &uast.Position{Offset: 1, Line: 1, Col: 2}
+	n := &uast.Node{
+		InternalType:  "Module",
+		StartPosition: pos,
+		Children: []*uast.Node{{
+			InternalType: "Wrapper",
+			Children: []*uast.Node{{
+				InternalType:  "Name",
+				Roles:         []uast.Role{uast.Identifier, uast.Expression, uast.Identifier},
+				StartPosition: pos,
+				EndPosition:   pos,
+			}},
+		}},
+	}
+
+	r := Normalize(n, NormalizeOptions{
+		StripPositions: true,
+		SortRoles:      true,
+		DropSynthetic:  true,
+		LowercaseTypes: true,
+	})
+	assert.Equal(t, &uast.Node{
+		InternalType: "module",
+		Children: []*uast.Node{{
+			InternalType: "name",
+			Roles:        []uast.Role{uast.Identifier, uast.Expression},
+		}},
+	}, r)
+
+	assert.Equal(t, "Module", n.InternalType)
+	assert.Len(t, n.Children[0].Children[0].Roles, 3)
+	assert.Equal(t, n, Normalize(n, NormalizeOptions{}))
+	assert.Nil(t, Normalize(nil, NormalizeOptions{}))
+}
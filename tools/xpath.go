@@ -0,0 +1,268 @@
+package tools
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+type xpathTokenKind int
+
+const (
+	xpathOperator xpathTokenKind = iota
+	xpathName
+	xpathNumber
+	xpathVariable
+	xpathLiteral
+)
+
+type xpathToken struct {
+	kind  xpathTokenKind
+	value string
+}
+
+// isWord reports whether the token is a name, a number or a variable reference.
+func (t xpathToken) isWord() bool {
+	return t.kind == xpathName || t.kind == xpathNumber || t.kind == xpathVariable
+}
+
+var xpathDoubleOperators = []string{"//", "::", "..", "!=", "<=", ">="}
+
+const xpathSingleOperators = "/()[]@,|+-=<>*."
+
+func isNameStart(c byte) bool {
+	return c == '_' || c >= 0x80 || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || isDigit(c) || c == '-' || c == '.'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// tokenizeXPath splits an XPath 1.0 expression in its lexical tokens,
+// discarding the whitespace between them.
+func tokenizeXPath(xpath string) ([]xpathToken, error) {
+	var tokens []xpathToken
+	for i := 0; i < len(xpath); {
+		c := xpath[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(xpath[i+1:], c)
+			if end < 0 {
+				return nil, &FilterError{Query: xpath, Kind: SyntaxError, Msg: fmt.Sprintf("unterminated literal at %d", i)}
+			}
+			tokens = append(tokens, xpathToken{xpathLiteral, xpath[i+1 : i+1+end]})
+			i += end + 2
+		case isDigit(c) || (c == '.' && i+1 < len(xpath) && isDigit(xpath[i+1])):
+			j := i
+			for j < len(xpath) && isDigit(xpath[j]) {
+				j++
+			}
+			if j < len(xpath) && xpath[j] == '.' {
+				j++
+				for j < len(xpath) && isDigit(xpath[j]) {
+					j++
+				}
+			}
+			tokens = append(tokens, xpathToken{xpathNumber, xpath[i:j]})
+			i = j
+		case isNameStart(c) || (c == '$' && i+1 < len(xpath) && isNameStart(xpath[i+1])):
+			kind := xpathName
+			j := i
+			if c == '$' {
+				kind = xpathVariable
+				j++
+			}
+			j = scanQName(xpath, j)
+			tokens = append(tokens, xpathToken{kind, xpath[i:j]})
+			i = j
+		default:
+			if i+1 < len(xpath) && isDoubleOperator(xpath[i:i+2]) {
+				tokens = append(tokens, xpathToken{xpathOperator, xpath[i : i+2]})
+				i += 2
+			} else if strings.IndexByte(xpathSingleOperators, c) >= 0 {
+				tokens = append(tokens, xpathToken{xpathOperator, xpath[i : i+1]})
+				i++
+			} else {
+				return nil, &FilterError{Query: xpath, Kind: SyntaxError, Msg: fmt.Sprintf("unexpected character %q at %d", c, i)}
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// scanQName returns the end of the (optionally prefixed) name starting at i.
+func scanQName(xpath string, i int) int {
+	for i < len(xpath) && isNameChar(xpath[i]) {
+		i++
+	}
+
+	if i+1 < len(xpath) && xpath[i] == ':' && xpath[i+1] != ':' {
+		if xpath[i+1] == '*' {
+			return i + 2
+		}
+		if isNameStart(xpath[i+1]) {
+			i++
+			for i < len(xpath) && isNameChar(xpath[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+func isDoubleOperator(s string) bool {
+	for _, op := range xpathDoubleOperators {
+		if s == op {
+			return true
+		}
+	}
+	return false
+}
+
+// needsSpace reports whether prev and next would be read as a different
+// sequence of tokens if they were written together.
+func needsSpace(prev, next xpathToken) bool {
+	if prev.kind == xpathLiteral || next.kind == xpathLiteral {
+		return false
+	}
+
+	if prev.isWord() && next.isWord() {
+		return true
+	}
+
+	if prev.isWord() && (next.value[0] == '.' || next.value[0] == '-') {
+		return true
+	}
+
+	if prev.value == "." && next.kind == xpathNumber {
+		return true
+	}
+
+	return prev.kind == xpathOperator && next.kind == xpathOperator &&
+		isDoubleOperator(prev.value[len(prev.value)-1:]+next.value[:1])
+}
+
+func quoteXPathLiteral(value string) string {
+	if strings.IndexByte(value, '\'') < 0 {
+		return "'" + value + "'"
+	}
+	return `"` + value + `"`
+}
+
+// CanonicalizeXPath returns a normalized form of the given XPath expression so
+// equivalent queries can be used as the same cache key. The normalization:
+//
+// - removes all the whitespace between tokens, except a single space where
+// it is needed to keep two tokens apart (e.g. `a and b`, or `a -b` since
+// `a-b` is a single name),
+// - writes all the string literals with single quotes, or double quotes if the
+// literal value contains a single quote.
+//
+// Names, numbers and the literal values themselves are left untouched. A
+// *FilterError of kind SyntaxError is returned if the expression is not valid.
+func CanonicalizeXPath(xpath string) (string, error) {
+	tokens, err := tokenizeXPath(xpath)
+	if err != nil {
+		return "", err
+	}
+
+	canonical := joinXPathTokens(tokens)
+	if len(canonical) == 0 {
+		return "", nil
+	}
+
+	if err := ValidateXPath(canonical); err != nil {
+		return "", err
+	}
+	return canonical, nil
+}
+
+// joinXPathTokens writes the tokens back as an expression, in the canonical
+// form described by CanonicalizeXPath.
+func joinXPathTokens(tokens []xpathToken) string {
+	var buf bytes.Buffer
+	for i, t := range tokens {
+		if i > 0 && needsSpace(tokens[i-1], t) {
+			buf.WriteByte(' ')
+		}
+
+		if t.kind == xpathLiteral {
+			buf.WriteString(quoteXPathLiteral(t.value))
+		} else {
+			buf.WriteString(t.value)
+		}
+	}
+	return buf.String()
+}
+
+// ExpandRoles rewrites the role predicates written with role names in the
+// given XPath expression into the role attributes of the nodes, so the result
+// can be passed to Filter or Prepare. Two forms are supported, with the role
+// name as a literal with either kind of quotes:
+//
+// - `role('Identifier')`, as a function call, is rewritten to `@roleIdentifier`,
+// - `@role='Identifier'`, only with the `@` abbreviation and the `=` operator,
+// is rewritten to `@roleIdentifier` too.
+//
+// So `//*[role('Function')]/*[@role='Identifier']` is rewritten to
+// `//*[@roleFunction]/*[@roleIdentifier]`. The names are the ones returned
+// by RoleName. The queries are not rewritten by Filter or Prepare themselves
+// since `@role='Identifier'` is also a valid comparison with a property named
+// "role". The result is in the canonical form returned by CanonicalizeXPath,
+// and a *FilterError of kind SyntaxError is returned if the expression can't be
+// tokenized or a role name is unknown.
+func ExpandRoles(xpath string) (string, error) {
+	tokens, err := tokenizeXPath(xpath)
+	if err != nil {
+		return "", err
+	}
+
+	isOp := func(i int, op string) bool {
+		return i < len(tokens) && tokens[i].kind == xpathOperator && tokens[i].value == op
+	}
+	isLiteral := func(i int) bool {
+		return i < len(tokens) && tokens[i].kind == xpathLiteral
+	}
+	roleAttribute := func(name string) (xpathToken, error) {
+		if _, ok := RoleByName(name); !ok {
+			return xpathToken{}, &FilterError{Query: xpath, Kind: SyntaxError, Msg: fmt.Sprintf("unknown role %q", name)}
+		}
+		return xpathToken{xpathName, "role" + name}, nil
+	}
+
+	expanded := make([]xpathToken, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.kind != xpathName || tok.value != "role" {
+			expanded = append(expanded, tok)
+			continue
+		}
+
+		afterAt := i > 0 && isOp(i-1, "@")
+		switch {
+		case !afterAt && isOp(i+1, "(") && isLiteral(i+2) && isOp(i+3, ")"):
+			attr, err := roleAttribute(tokens[i+2].value)
+			if err != nil {
+				return "", err
+			}
+			expanded = append(expanded, xpathToken{xpathOperator, "@"}, attr)
+			i += 3
+		case afterAt && isOp(i+1, "=") && isLiteral(i+2):
+			attr, err := roleAttribute(tokens[i+2].value)
+			if err != nil {
+				return "", err
+			}
+			expanded = append(expanded, attr)
+			i += 2
+		default:
+			expanded = append(expanded, tok)
+		}
+	}
+	return joinXPathTokens(expanded), nil
+}
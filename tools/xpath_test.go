@@ -0,0 +1,68 @@
+package tools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/bblfsh/sdk.v1/uast"
+)
+
+func TestCanonicalizeXPath(t *testing.T) {
+	cases := map[string]string{
+		"//a":                           "//a",
+		" // a [ @token = \"b\" ] ":     "//a[@token='b']",
+		"//*[@token=\"it's\"]":          "//*[@token=\"it's\"]",
+		"count( //a ) > 1 and true()":   "count(//a)>1 and true()",
+		"//*[@startOffset - 1 = 0]":     "//*[@startOffset -1=0]",
+		"//a | //b":                     "//a|//b",
+		"child::a / descendant::b[ 1 ]": "child::a/descendant::b[1]",
+		". / a":                         "./a",
+	}
+
+	for query, expected := range cases {
+		r, err := CanonicalizeXPath(query)
+		assert.Nil(t, err, query)
+		assert.Equal(t, expected, r, query)
+	}
+}
+
+func TestCanonicalizeXPath_Invalid(t *testing.T) {
+	for _, query := range []string{":", "//a[@token='b]", "//a[", "//a#"} {
+		_, err := CanonicalizeXPath(query)
+		assert.IsType(t, &FilterError{}, err, query)
+	}
+}
+
+func TestExpandRoles(t *testing.T) {
+	cases := map[string]string{
+		"//*[role('Identifier')]":                         "//*[@roleIdentifier]",
+		"//*[role(\"Function\") and @role='Declaration']": "//*[@roleFunction and@roleDeclaration]",
+		"//*[ @role = 'Import' ]/*[not(role('Call'))]":    "//*[@roleImport]/*[not(@roleCall)]",
+		"//role[@role!='Call']":                           "//role[@role!='Call']",
+		"//*[@token='role']":                              "//*[@token='role']",
+		"":                                                "",
+	}
+
+	for query, expected := range cases {
+		r, err := ExpandRoles(query)
+		assert.Nil(t, err, query)
+		assert.Equal(t, expected, r, query)
+	}
+
+	for _, query := range []string{"//*[role('Unknown')]", "//*[@role='identifier']", "//*[role('Call]"} {
+		_, err := ExpandRoles(query)
+		assert.IsType(t, &FilterError{}, err, query)
+	}
+}
+
+func TestExpandRoles_Filter(t *testing.T) {
+	n := nodeTree()
+	n.Children[1].Roles = []uast.Role{uast.Function, uast.Declaration}
+	n.Children[1].Children[0].Roles = []uast.Role{uast.Identifier}
+
+	query, err := ExpandRoles("//*[role('Function') and @role='Declaration']/*[role('Identifier')]")
+	assert.Nil(t, err)
+	r, err := Filter(n, query)
+	assert.Nil(t, err)
+	assert.Equal(t, []*uast.Node{n.Children[1].Children[0]}, r)
+}